@@ -0,0 +1,74 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/gofiber/fiber/v2"
+)
+
+const accountLocaleSchema = `
+CREATE TABLE IF NOT EXISTS account_locale (
+	account_uuid TEXT PRIMARY KEY,
+	locale       TEXT NOT NULL,
+	updated_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+`
+
+// AccountLocales stores the language each account wants its emails in, in
+// a table owned by this service since commonuser accounts have no locale.
+type AccountLocales struct{}
+
+func NewAccountLocales() *AccountLocales {
+	return &AccountLocales{}
+}
+
+func (l *AccountLocales) EnsureSchema(db *sql.DB) error {
+	_, errExec := db.Exec(accountLocaleSchema)
+	return errExec
+}
+
+// Get returns the account's locale, or "" when it never chose one.
+func (l *AccountLocales) Get(db *sql.DB, accountUUID string) (string, error) {
+	var locale string
+	errScan := db.QueryRow(`SELECT locale FROM account_locale WHERE account_uuid = $1`, accountUUID).Scan(&locale)
+	if errors.Is(errScan, sql.ErrNoRows) {
+		return "", nil
+	}
+	return locale, errScan
+}
+
+func (l *AccountLocales) Set(db sqlExecutor, accountUUID string, locale string) error {
+	_, errExec := db.Exec(`
+		INSERT INTO account_locale (account_uuid, locale) VALUES ($1, $2)
+		ON CONFLICT (account_uuid) DO UPDATE SET locale = EXCLUDED.locale, updated_at = now()`,
+		accountUUID, locale)
+	return errExec
+}
+
+// Resolve picks the language of an email to the account: its stored locale,
+// else the best match for the request's Accept-Language, else
+// DefaultLanguage. A lookup failure falls through to the request.
+func (l *AccountLocales) Resolve(c *fiber.Ctx, db *sql.DB, accountUUID string) string {
+	if accountUUID != "" {
+		locale, errGet := l.Get(db, accountUUID)
+		if errGet != nil {
+			Logger.Error("locale-error", "component", LogComponent, "error", errGet.Error())
+		}
+		if isSupportedLanguage(locale) {
+			return locale
+		}
+	}
+	if language := c.AcceptsLanguages(SupportedLanguages...); language != "" {
+		return language
+	}
+	return DefaultLanguage
+}
+
+func isSupportedLanguage(locale string) bool {
+	for _, language := range SupportedLanguages {
+		if locale == language {
+			return true
+		}
+	}
+	return false
+}
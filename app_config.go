@@ -0,0 +1,850 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultListenAddr             = ":3000"
+	DefaultJWTIssuer              = "commonuser-api.com"
+	DefaultJWTKeyID               = "default"
+	DefaultJWTLifespan            = 24 * 14 * time.Hour // 14 days
+	DefaultSSLMode                = "disable"
+	DefaultLogComponent           = "commonuser"
+	DefaultSessionCacheTTL        = 30 * time.Second
+	DefaultSessionCacheMaxEntries = 10000
+	MinJWTSecretLength            = 16
+	DefaultPasswordMinLength      = 8
+	DefaultPasswordMaxLength      = 255
+	DefaultPasswordMinScore       = 2
+	DefaultPasswordHistorySize    = 5
+	DefaultMailCaptureDir         = "mail-capture"
+	DefaultMailProductName        = "Commonuser"
+	DefaultSMTPPort               = "587"
+)
+
+var validSSLModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+type DatabaseConfig struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+	Name     string
+	SSLMode  string
+}
+
+type RedisConfig struct {
+	Host      string
+	Username  string
+	Password  string
+	Clustered bool
+}
+
+// PreviousJWTKey is a retired signing key that still verifies tokens until
+// RetireAt. A zero RetireAt means "one JWT lifespan after boot". Exactly one
+// of Secret (HMAC) or PEM (RSA/Ed25519, public or private) is set.
+type PreviousJWTKey struct {
+	ID       string
+	Secret   string
+	PEM      string
+	RetireAt time.Time
+}
+
+// JWTConfig.Secret is always required because commonuser signs with it
+// internally. When PrivateKey is set, tokens handed to clients are re-signed
+// with it (RS256 or EdDSA, depending on the key type) instead.
+type JWTConfig struct {
+	KeyID        string
+	Secret       string
+	PrivateKey   string
+	Issuer       string
+	Lifespan     time.Duration
+	PreviousKeys []PreviousJWTKey
+}
+
+type LogConfig struct {
+	Component    string
+	RedactFields []string
+}
+
+// SessionConfig.VerifyOnEveryRequest makes every protected route check the
+// session cache. Sensitive routes always check, regardless of this flag.
+type SessionConfig struct {
+	RevokeAllOnRefreshReuse bool
+	VerifyOnEveryRequest    bool
+	CacheTTL                time.Duration
+	CacheMaxEntries         int
+}
+
+// GoogleConfig enables /auth/google when at least one OAuth client ID is
+// set; ID tokens must be issued to one of them.
+type GoogleConfig struct {
+	ClientIDs []string
+	JWKSURL   string
+}
+
+// OIDCProviderConfig describes one login provider for the authorization code
+// + PKCE flow. Issuer enables discovery; the explicit URLs override it and are
+// enough on their own for plain OAuth2 providers without discovery.
+// ResponseMode is sent as response_mode; form_post has the provider POST the
+// callback instead of redirecting with a query string.
+type OIDCProviderConfig struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	AuthURL      string
+	TokenURL     string
+	UserinfoURL  string
+	SubjectClaim string
+	TrustEmail   bool
+	ResponseMode string
+}
+
+// oidcPresets fill in the well-known settings of common providers, so only
+// the client credentials and redirect URL have to be configured for them.
+var oidcPresets = map[string]OIDCProviderConfig{
+	"github": {
+		AuthURL:      "https://github.com/login/oauth/authorize",
+		TokenURL:     "https://github.com/login/oauth/access_token",
+		UserinfoURL:  "https://api.github.com/user",
+		Scopes:       []string{"read:user", "user:email"},
+		SubjectClaim: "id",
+	},
+	// the consumers tenant by id: the /consumers/v2.0 alias publishes this
+	// issuer in its discovery document, which must match the configured one
+	"microsoft": {
+		Issuer: "https://login.microsoftonline.com/9188040d-6c67-4c5b-b112-36a304b66dad/v2.0",
+	},
+	// Apple's client secret is a JWT signed with the developer key; generate
+	// it out of band and configure it like any other secret.
+	"apple": {
+		Issuer:       "https://appleid.apple.com",
+		Scopes:       []string{"openid", "email", "name"},
+		ResponseMode: "form_post",
+	},
+}
+
+var validOIDCProviderName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// ProviderLinkConfig.Policy decides what happens when a first provider login
+// carries the email of an existing account: "verified-email" links it right
+// away if both the provider and the account verified the email, "password"
+// always asks the account owner to confirm with their password first.
+type ProviderLinkConfig struct {
+	Policy string
+}
+
+// PasswordConfig drives the PasswordPolicy applied wherever a password is
+// chosen. MinScore is on zxcvbn's 0-4 scale; RequiredClasses names any of
+// lower, upper, digit and symbol. BreachedFile is a filter built with the
+// build-breach-filter command; passwords found in it are rejected. The last
+// HistorySize passwords of an account cannot be chosen again.
+type PasswordConfig struct {
+	MinLength          int
+	MaxLength          int
+	RequiredClasses    []string
+	MinScore           int
+	ForbidPersonalInfo bool
+	BreachedFile       string
+	HistorySize        int
+}
+
+// MailConfig selects how emails are delivered: "smtp" for real delivery or
+// "file" to write .eml files into CaptureDir, for development. There is no
+// default, so a deployment has to choose one.
+// ProductName is how the email templates refer to the service.
+type MailConfig struct {
+	Backend      string
+	From         string
+	ProductName  string
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+	SMTPSecurity string
+	CaptureDir   string
+}
+
+// AdminConfig lists the accounts allowed to use the /admin routes.
+type AdminConfig struct {
+	AccountUUIDs []string
+}
+
+type AppConfig struct {
+	ListenAddr   string
+	ErrorDocsURL string
+	WriteDB      DatabaseConfig
+	ReadDB       DatabaseConfig
+	Redis        RedisConfig
+	JWT          JWTConfig
+	Log          LogConfig
+	Session      SessionConfig
+	Admin        AdminConfig
+	Google       GoogleConfig
+	OIDC         []OIDCProviderConfig
+	ProviderLink ProviderLinkConfig
+	Password     PasswordConfig
+	Mail         MailConfig
+}
+
+// ConfigError collects every problem found while loading the configuration,
+// so the operator can fix all of them in one go instead of one per restart.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("invalid configuration (%d problem(s)):", len(e.Problems)))
+	for _, problem := range e.Problems {
+		sb.WriteString("\n  - ")
+		sb.WriteString(problem)
+	}
+	return sb.String()
+}
+
+func (e *ConfigError) add(format string, args ...any) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// fileValue keeps any scalar from the config file as its string form, so the
+// file and the environment share the same parsing and validation path. A
+// list becomes its items joined by commas, the form list settings take in
+// the environment.
+type fileValue string
+
+func (v *fileValue) UnmarshalTOML(data any) error {
+	items, isList := data.([]any)
+	if !isList {
+		*v = fileValue(fmt.Sprint(data))
+		return nil
+	}
+
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		switch item.(type) {
+		case []any, map[string]any:
+			return fmt.Errorf("list items must be scalars, got %v", item)
+		}
+		values = append(values, fmt.Sprint(item))
+	}
+	*v = fileValue(strings.Join(values, ","))
+	return nil
+}
+
+func (v *fileValue) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		*v = fileValue(node.Value)
+		return nil
+	case yaml.SequenceNode:
+		values := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return fmt.Errorf("line %d: list items must be scalars", item.Line)
+			}
+			values = append(values, item.Value)
+		}
+		*v = fileValue(strings.Join(values, ","))
+		return nil
+	}
+	return fmt.Errorf("line %d: expected a value or a list of values", node.Line)
+}
+
+type fileDatabaseConfig struct {
+	Host     fileValue `yaml:"host" toml:"host"`
+	Port     fileValue `yaml:"port" toml:"port"`
+	User     fileValue `yaml:"user" toml:"user"`
+	Password fileValue `yaml:"password" toml:"password"`
+	Name     fileValue `yaml:"name" toml:"name"`
+	SSLMode  fileValue `yaml:"sslmode" toml:"sslmode"`
+}
+
+type fileRedisConfig struct {
+	Host      fileValue `yaml:"host" toml:"host"`
+	Username  fileValue `yaml:"username" toml:"username"`
+	Password  fileValue `yaml:"password" toml:"password"`
+	Clustered fileValue `yaml:"clustered" toml:"clustered"`
+}
+
+type fileJWTConfig struct {
+	KeyID        fileValue `yaml:"keyId" toml:"keyId"`
+	Secret       fileValue `yaml:"secret" toml:"secret"`
+	PrivateKey   fileValue `yaml:"privateKey" toml:"privateKey"`
+	Issuer       fileValue `yaml:"issuer" toml:"issuer"`
+	Lifespan     fileValue `yaml:"lifespan" toml:"lifespan"`
+	PreviousKeys fileValue `yaml:"previousKeys" toml:"previousKeys"`
+}
+
+type fileLogConfig struct {
+	Component    fileValue `yaml:"component" toml:"component"`
+	RedactFields fileValue `yaml:"redactFields" toml:"redactFields"`
+}
+
+type fileSessionConfig struct {
+	RevokeAllOnRefreshReuse fileValue `yaml:"revokeAllOnRefreshReuse" toml:"revokeAllOnRefreshReuse"`
+	VerifyOnEveryRequest    fileValue `yaml:"verifyOnEveryRequest" toml:"verifyOnEveryRequest"`
+	CacheTTL                fileValue `yaml:"cacheTTL" toml:"cacheTTL"`
+	CacheMaxEntries         fileValue `yaml:"cacheMaxEntries" toml:"cacheMaxEntries"`
+}
+
+type fileAdminConfig struct {
+	AccountUUIDs fileValue `yaml:"accountUUIDs" toml:"accountUUIDs"`
+}
+
+type fileGoogleConfig struct {
+	ClientIDs fileValue `yaml:"clientIDs" toml:"clientIDs"`
+	JWKSURL   fileValue `yaml:"jwksURL" toml:"jwksURL"`
+}
+
+type fileOIDCProviderConfig struct {
+	Issuer       fileValue `yaml:"issuer" toml:"issuer"`
+	ClientID     fileValue `yaml:"clientID" toml:"clientID"`
+	ClientSecret fileValue `yaml:"clientSecret" toml:"clientSecret"`
+	RedirectURL  fileValue `yaml:"redirectURL" toml:"redirectURL"`
+	Scopes       fileValue `yaml:"scopes" toml:"scopes"`
+	AuthURL      fileValue `yaml:"authURL" toml:"authURL"`
+	TokenURL     fileValue `yaml:"tokenURL" toml:"tokenURL"`
+	UserinfoURL  fileValue `yaml:"userinfoURL" toml:"userinfoURL"`
+	SubjectClaim fileValue `yaml:"subjectClaim" toml:"subjectClaim"`
+	TrustEmail   fileValue `yaml:"trustEmail" toml:"trustEmail"`
+	ResponseMode fileValue `yaml:"responseMode" toml:"responseMode"`
+}
+
+type fileProviderLinkConfig struct {
+	Policy fileValue `yaml:"policy" toml:"policy"`
+}
+
+type filePasswordConfig struct {
+	MinLength          fileValue `yaml:"minLength" toml:"minLength"`
+	MaxLength          fileValue `yaml:"maxLength" toml:"maxLength"`
+	RequiredClasses    fileValue `yaml:"requiredClasses" toml:"requiredClasses"`
+	MinScore           fileValue `yaml:"minScore" toml:"minScore"`
+	ForbidPersonalInfo fileValue `yaml:"forbidPersonalInfo" toml:"forbidPersonalInfo"`
+	BreachedFile       fileValue `yaml:"breachedFile" toml:"breachedFile"`
+	HistorySize        fileValue `yaml:"historySize" toml:"historySize"`
+}
+
+type fileMailConfig struct {
+	Backend      fileValue `yaml:"backend" toml:"backend"`
+	From         fileValue `yaml:"from" toml:"from"`
+	ProductName  fileValue `yaml:"productName" toml:"productName"`
+	SMTPHost     fileValue `yaml:"smtpHost" toml:"smtpHost"`
+	SMTPPort     fileValue `yaml:"smtpPort" toml:"smtpPort"`
+	SMTPUsername fileValue `yaml:"smtpUsername" toml:"smtpUsername"`
+	SMTPPassword fileValue `yaml:"smtpPassword" toml:"smtpPassword"`
+	SMTPSecurity fileValue `yaml:"smtpSecurity" toml:"smtpSecurity"`
+	CaptureDir   fileValue `yaml:"captureDir" toml:"captureDir"`
+}
+
+type fileConfig struct {
+	ListenAddr   fileValue              `yaml:"listenAddr" toml:"listenAddr"`
+	ErrorDocsURL fileValue              `yaml:"errorDocsURL" toml:"errorDocsURL"`
+	WriteDB      fileDatabaseConfig     `yaml:"writeDB" toml:"writeDB"`
+	ReadDB       fileDatabaseConfig     `yaml:"readDB" toml:"readDB"`
+	Redis        fileRedisConfig        `yaml:"redis" toml:"redis"`
+	JWT          fileJWTConfig          `yaml:"jwt" toml:"jwt"`
+	Log          fileLogConfig          `yaml:"log" toml:"log"`
+	Session      fileSessionConfig      `yaml:"session" toml:"session"`
+	Admin        fileAdminConfig        `yaml:"admin" toml:"admin"`
+	Google       fileGoogleConfig       `yaml:"google" toml:"google"`
+	ProviderLink fileProviderLinkConfig `yaml:"providerLink" toml:"providerLink"`
+	Password     filePasswordConfig     `yaml:"password" toml:"password"`
+	Mail         fileMailConfig         `yaml:"mail" toml:"mail"`
+
+	OIDC map[string]fileOIDCProviderConfig `yaml:"oidc" toml:"oidc"`
+}
+
+func (f fileConfig) values() map[string]string {
+	values := map[string]string{
+		"LISTEN_ADDR":                         string(f.ListenAddr),
+		"ERROR_DOCS_URL":                      string(f.ErrorDocsURL),
+		"DB_WRITE_HOST":                       string(f.WriteDB.Host),
+		"DB_WRITE_PORT":                       string(f.WriteDB.Port),
+		"DB_WRITE_USER":                       string(f.WriteDB.User),
+		"DB_WRITE_PASSWORD":                   string(f.WriteDB.Password),
+		"DB_WRITE_NAME":                       string(f.WriteDB.Name),
+		"DB_WRITE_SSLMODE":                    string(f.WriteDB.SSLMode),
+		"DB_READ_HOST":                        string(f.ReadDB.Host),
+		"DB_READ_PORT":                        string(f.ReadDB.Port),
+		"DB_READ_USER":                        string(f.ReadDB.User),
+		"DB_READ_PASSWORD":                    string(f.ReadDB.Password),
+		"DB_READ_NAME":                        string(f.ReadDB.Name),
+		"DB_READ_SSLMODE":                     string(f.ReadDB.SSLMode),
+		"REDIS_HOST":                          string(f.Redis.Host),
+		"REDIS_USER":                          string(f.Redis.Username),
+		"REDIS_PASS":                          string(f.Redis.Password),
+		"REDIS_CLUSTERED":                     string(f.Redis.Clustered),
+		"JWT_KID":                             string(f.JWT.KeyID),
+		"JWT_SECRET":                          string(f.JWT.Secret),
+		"JWT_PRIVATE_KEY":                     string(f.JWT.PrivateKey),
+		"JWT_ISSUER":                          string(f.JWT.Issuer),
+		"JWT_LIFESPAN":                        string(f.JWT.Lifespan),
+		"JWT_PREVIOUS_KEYS":                   string(f.JWT.PreviousKeys),
+		"LOG_COMPONENT":                       string(f.Log.Component),
+		"LOG_REDACT_FIELDS":                   string(f.Log.RedactFields),
+		"SESSION_REVOKE_ALL_ON_REFRESH_REUSE": string(f.Session.RevokeAllOnRefreshReuse),
+		"SESSION_VERIFY_ON_EVERY_REQUEST":     string(f.Session.VerifyOnEveryRequest),
+		"SESSION_CACHE_TTL":                   string(f.Session.CacheTTL),
+		"SESSION_CACHE_MAX_ENTRIES":           string(f.Session.CacheMaxEntries),
+		"ADMIN_ACCOUNT_UUIDS":                 string(f.Admin.AccountUUIDs),
+		"GOOGLE_CLIENT_IDS":                   string(f.Google.ClientIDs),
+		"GOOGLE_JWKS_URL":                     string(f.Google.JWKSURL),
+		"PROVIDER_LINK_POLICY":                string(f.ProviderLink.Policy),
+		"PASSWORD_MIN_LENGTH":                 string(f.Password.MinLength),
+		"PASSWORD_MAX_LENGTH":                 string(f.Password.MaxLength),
+		"PASSWORD_REQUIRED_CLASSES":           string(f.Password.RequiredClasses),
+		"PASSWORD_MIN_SCORE":                  string(f.Password.MinScore),
+		"PASSWORD_FORBID_PERSONAL_INFO":       string(f.Password.ForbidPersonalInfo),
+		"PASSWORD_BREACHED_FILE":              string(f.Password.BreachedFile),
+		"PASSWORD_HISTORY_SIZE":               string(f.Password.HistorySize),
+		"MAIL_BACKEND":                        string(f.Mail.Backend),
+		"MAIL_FROM":                           string(f.Mail.From),
+		"MAIL_PRODUCT_NAME":                   string(f.Mail.ProductName),
+		"MAIL_CAPTURE_DIR":                    string(f.Mail.CaptureDir),
+		"SMTP_HOST":                           string(f.Mail.SMTPHost),
+		"SMTP_PORT":                           string(f.Mail.SMTPPort),
+		"SMTP_USERNAME":                       string(f.Mail.SMTPUsername),
+		"SMTP_PASSWORD":                       string(f.Mail.SMTPPassword),
+		"SMTP_SECURITY":                       string(f.Mail.SMTPSecurity),
+	}
+
+	var providerNames []string
+	for name, provider := range f.OIDC {
+		providerNames = append(providerNames, name)
+		prefix := oidcEnvPrefix(name)
+		values[prefix+"ISSUER"] = string(provider.Issuer)
+		values[prefix+"CLIENT_ID"] = string(provider.ClientID)
+		values[prefix+"CLIENT_SECRET"] = string(provider.ClientSecret)
+		values[prefix+"REDIRECT_URL"] = string(provider.RedirectURL)
+		values[prefix+"SCOPES"] = string(provider.Scopes)
+		values[prefix+"AUTH_URL"] = string(provider.AuthURL)
+		values[prefix+"TOKEN_URL"] = string(provider.TokenURL)
+		values[prefix+"USERINFO_URL"] = string(provider.UserinfoURL)
+		values[prefix+"SUBJECT_CLAIM"] = string(provider.SubjectClaim)
+		values[prefix+"TRUST_EMAIL"] = string(provider.TrustEmail)
+		values[prefix+"RESPONSE_MODE"] = string(provider.ResponseMode)
+	}
+	sort.Strings(providerNames)
+	values["OIDC_PROVIDERS"] = strings.Join(providerNames, ",")
+
+	return values
+}
+
+func oidcEnvPrefix(name string) string {
+	return "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+}
+
+// configSource resolves a setting by key. Environment variables take
+// precedence over the config file, and KEY_FILE points at a file holding the
+// value (e.g. a mounted secret) when KEY itself is not set.
+type configSource struct {
+	file   map[string]string
+	errors *ConfigError
+}
+
+func (s *configSource) get(key string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return strings.TrimSpace(value)
+	}
+
+	if path, ok := os.LookupEnv(key + "_FILE"); ok {
+		content, errRead := os.ReadFile(path)
+		if errRead != nil {
+			s.errors.add("%s_FILE: cannot read %q: %v", key, path, errRead)
+			return ""
+		}
+		return strings.TrimSpace(string(content))
+	}
+
+	return strings.TrimSpace(s.file[key])
+}
+
+func (s *configSource) required(key string) string {
+	value := s.get(key)
+	if value == "" {
+		s.errors.add("%s: required but not set", key)
+	}
+	return value
+}
+
+func (s *configSource) withDefault(key string, fallback string) string {
+	value := s.get(key)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+func (s *configSource) bool(key string, fallback bool) bool {
+	value := s.get(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, errParse := strconv.ParseBool(value)
+	if errParse != nil {
+		s.errors.add("%s: %q is not a boolean", key, value)
+		return fallback
+	}
+	return parsed
+}
+
+func (s *configSource) positiveInt(key string, fallback int) int {
+	value := s.get(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, errParse := strconv.Atoi(value)
+	if errParse != nil || parsed <= 0 {
+		s.errors.add("%s: %q is not a positive integer", key, value)
+		return fallback
+	}
+	return parsed
+}
+
+func (s *configSource) intRange(key string, fallback int, min int, max int) int {
+	value := s.get(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, errParse := strconv.Atoi(value)
+	if errParse != nil || parsed < min || parsed > max {
+		s.errors.add("%s: %q must be an integer from %d to %d", key, value, min, max)
+		return fallback
+	}
+	return parsed
+}
+
+func (s *configSource) duration(key string, fallback time.Duration) time.Duration {
+	value := s.get(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, errParse := time.ParseDuration(value)
+	if errParse != nil {
+		s.errors.add("%s: %q is not a duration (e.g. 336h, 15m)", key, value)
+		return fallback
+	}
+	if parsed <= 0 {
+		s.errors.add("%s: must be positive, got %s", key, value)
+		return fallback
+	}
+	return parsed
+}
+
+func (s *configSource) list(key string) []string {
+	value := s.get(key)
+	if value == "" {
+		return nil
+	}
+
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (s *configSource) database(prefix string) DatabaseConfig {
+	db := DatabaseConfig{
+		Host:     s.required(prefix + "_HOST"),
+		Port:     s.required(prefix + "_PORT"),
+		User:     s.required(prefix + "_USER"),
+		Password: s.get(prefix + "_PASSWORD"),
+		Name:     s.required(prefix + "_NAME"),
+		SSLMode:  s.withDefault(prefix+"_SSLMODE", DefaultSSLMode),
+	}
+
+	if db.Port != "" {
+		port, errPort := strconv.Atoi(db.Port)
+		if errPort != nil || port < 1 || port > 65535 {
+			s.errors.add("%s_PORT: %q is not a valid port", prefix, db.Port)
+		}
+	}
+
+	validMode := false
+	for _, mode := range validSSLModes {
+		if db.SSLMode == mode {
+			validMode = true
+			break
+		}
+	}
+	if !validMode {
+		s.errors.add("%s_SSLMODE: %q must be one of %s", prefix, db.SSLMode, strings.Join(validSSLModes, ", "))
+	}
+
+	return db
+}
+
+// previousJWTKeys parses a comma separated list of kid:secret or
+// kid:pem=/path/to/key.pem entries, each optionally suffixed with
+// @<RFC3339 retirement time>.
+func (s *configSource) previousJWTKeys(key string) []PreviousJWTKey {
+	value := s.get(key)
+	if value == "" {
+		return nil
+	}
+
+	var keys []PreviousJWTKey
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		kid, secret, found := strings.Cut(entry, ":")
+		if !found || kid == "" || secret == "" {
+			s.errors.add("%s: entry %q must look like kid:secret[@retireAt]", key, entry)
+			continue
+		}
+
+		previousKey := PreviousJWTKey{ID: kid, Secret: secret}
+		if at := strings.LastIndex(secret, "@"); at != -1 {
+			retireAt, errParse := time.Parse(time.RFC3339, secret[at+1:])
+			if errParse == nil {
+				previousKey.Secret = secret[:at]
+				previousKey.RetireAt = retireAt
+			}
+		}
+
+		if path, isPEM := strings.CutPrefix(previousKey.Secret, "pem="); isPEM {
+			content, errRead := os.ReadFile(path)
+			if errRead != nil {
+				s.errors.add("%s: cannot read key file for kid %q: %v", key, kid, errRead)
+				continue
+			}
+			previousKey.Secret = ""
+			previousKey.PEM = string(content)
+		} else if len(previousKey.Secret) < MinJWTSecretLength {
+			s.errors.add("%s: secret for kid %q must be at least %d characters", key, kid, MinJWTSecretLength)
+		}
+		keys = append(keys, previousKey)
+	}
+	return keys
+}
+
+// oidcProviders reads OIDC_PROVIDERS, a comma separated list of provider
+// names, and the OIDC_<NAME>_* settings of each one on top of its preset.
+func (s *configSource) oidcProviders(key string) []OIDCProviderConfig {
+	var providers []OIDCProviderConfig
+	for _, name := range s.list(key) {
+		name = strings.ToLower(name)
+		if !validOIDCProviderName.MatchString(name) {
+			s.errors.add("%s: provider name %q must be lowercase letters, digits and dashes", key, name)
+			continue
+		}
+
+		prefix := oidcEnvPrefix(name)
+		provider := oidcPresets[name]
+		provider.Name = name
+		provider.Issuer = s.withDefault(prefix+"ISSUER", provider.Issuer)
+		provider.ClientID = s.required(prefix + "CLIENT_ID")
+		provider.ClientSecret = s.get(prefix + "CLIENT_SECRET")
+		provider.RedirectURL = s.required(prefix + "REDIRECT_URL")
+		provider.AuthURL = s.withDefault(prefix+"AUTH_URL", provider.AuthURL)
+		provider.TokenURL = s.withDefault(prefix+"TOKEN_URL", provider.TokenURL)
+		provider.UserinfoURL = s.withDefault(prefix+"USERINFO_URL", provider.UserinfoURL)
+		provider.SubjectClaim = s.withDefault(prefix+"SUBJECT_CLAIM", provider.SubjectClaim)
+		if provider.SubjectClaim == "" {
+			provider.SubjectClaim = "sub"
+		}
+		provider.TrustEmail = s.bool(prefix+"TRUST_EMAIL", false)
+		provider.ResponseMode = s.withDefault(prefix+"RESPONSE_MODE", provider.ResponseMode)
+		switch provider.ResponseMode {
+		case "", "query", "form_post":
+		default:
+			s.errors.add("%sRESPONSE_MODE: %q must be query or form_post", prefix, provider.ResponseMode)
+		}
+
+		if scopes := s.list(prefix + "SCOPES"); scopes != nil {
+			provider.Scopes = scopes
+		} else if provider.Scopes == nil {
+			provider.Scopes = []string{"openid", "email", "profile"}
+		}
+
+		if provider.Issuer == "" && (provider.AuthURL == "" || provider.TokenURL == "") {
+			s.errors.add("%sISSUER: required unless both %sAUTH_URL and %sTOKEN_URL are set", prefix, prefix, prefix)
+		}
+		if provider.Issuer == "" && provider.UserinfoURL == "" {
+			s.errors.add("%sUSERINFO_URL: required when no issuer is configured", prefix)
+		}
+
+		providers = append(providers, provider)
+	}
+	return providers
+}
+
+func (s *configSource) mail() MailConfig {
+	mailConfig := MailConfig{
+		Backend:     s.required("MAIL_BACKEND"),
+		From:        s.required("MAIL_FROM"),
+		ProductName: s.withDefault("MAIL_PRODUCT_NAME", DefaultMailProductName),
+		CaptureDir:  s.withDefault("MAIL_CAPTURE_DIR", DefaultMailCaptureDir),
+	}
+
+	if mailConfig.From != "" {
+		if _, errParse := mail.ParseAddress(mailConfig.From); errParse != nil {
+			s.errors.add("MAIL_FROM: %q is not an email address", mailConfig.From)
+		}
+	}
+
+	switch mailConfig.Backend {
+	case MailBackendSMTP:
+		mailConfig.SMTPHost = s.required("SMTP_HOST")
+		mailConfig.SMTPPort = s.withDefault("SMTP_PORT", DefaultSMTPPort)
+		mailConfig.SMTPUsername = s.get("SMTP_USERNAME")
+		mailConfig.SMTPPassword = s.get("SMTP_PASSWORD")
+		mailConfig.SMTPSecurity = s.withDefault("SMTP_SECURITY", SMTPSecurityStartTLS)
+
+		port, errPort := strconv.Atoi(mailConfig.SMTPPort)
+		if errPort != nil || port < 1 || port > 65535 {
+			s.errors.add("SMTP_PORT: %q is not a valid port", mailConfig.SMTPPort)
+		}
+		switch mailConfig.SMTPSecurity {
+		case SMTPSecurityStartTLS, SMTPSecurityTLS, SMTPSecurityNone:
+		default:
+			s.errors.add("SMTP_SECURITY: %q must be one of %s, %s, %s", mailConfig.SMTPSecurity, SMTPSecurityStartTLS, SMTPSecurityTLS, SMTPSecurityNone)
+		}
+	case MailBackendFile, "":
+	default:
+		s.errors.add("MAIL_BACKEND: %q must be one of %s, %s", mailConfig.Backend, MailBackendSMTP, MailBackendFile)
+	}
+	return mailConfig
+}
+
+func readConfigFile(path string) (map[string]string, error) {
+	content, errRead := os.ReadFile(path)
+	if errRead != nil {
+		return nil, errRead
+	}
+
+	var parsed fileConfig
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if errDecode := yaml.Unmarshal(content, &parsed); errDecode != nil {
+			return nil, errDecode
+		}
+	case ".toml":
+		if errDecode := toml.Unmarshal(content, &parsed); errDecode != nil {
+			return nil, errDecode
+		}
+	default:
+		return nil, errors.New("unsupported extension, expected .yaml, .yml or .toml")
+	}
+
+	return parsed.values(), nil
+}
+
+// LoadAppConfig reads the optional file named by CONFIG_FILE, overlays the
+// environment and validates the result. All problems are reported at once
+// through a *ConfigError.
+func LoadAppConfig() (*AppConfig, error) {
+	configErrors := &ConfigError{}
+	source := &configSource{file: map[string]string{}, errors: configErrors}
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		fileValues, errFile := readConfigFile(path)
+		if errFile != nil {
+			configErrors.add("CONFIG_FILE: cannot load %q: %v", path, errFile)
+		} else {
+			source.file = fileValues
+		}
+	}
+
+	appConfig := &AppConfig{
+		ListenAddr:   source.withDefault("LISTEN_ADDR", DefaultListenAddr),
+		ErrorDocsURL: source.get("ERROR_DOCS_URL"),
+		WriteDB:      source.database("DB_WRITE"),
+		ReadDB:       source.database("DB_READ"),
+		Redis: RedisConfig{
+			Host:      source.required("REDIS_HOST"),
+			Username:  source.get("REDIS_USER"),
+			Password:  source.get("REDIS_PASS"),
+			Clustered: source.bool("REDIS_CLUSTERED", false),
+		},
+		JWT: JWTConfig{
+			KeyID:        source.withDefault("JWT_KID", DefaultJWTKeyID),
+			Secret:       source.required("JWT_SECRET"),
+			PrivateKey:   source.get("JWT_PRIVATE_KEY"),
+			Issuer:       source.withDefault("JWT_ISSUER", DefaultJWTIssuer),
+			Lifespan:     source.duration("JWT_LIFESPAN", DefaultJWTLifespan),
+			PreviousKeys: source.previousJWTKeys("JWT_PREVIOUS_KEYS"),
+		},
+		Log: LogConfig{
+			Component:    source.withDefault("LOG_COMPONENT", DefaultLogComponent),
+			RedactFields: source.list("LOG_REDACT_FIELDS"),
+		},
+		Session: SessionConfig{
+			RevokeAllOnRefreshReuse: source.bool("SESSION_REVOKE_ALL_ON_REFRESH_REUSE", false),
+			VerifyOnEveryRequest:    source.bool("SESSION_VERIFY_ON_EVERY_REQUEST", true),
+			CacheTTL:                source.duration("SESSION_CACHE_TTL", DefaultSessionCacheTTL),
+			CacheMaxEntries:         source.positiveInt("SESSION_CACHE_MAX_ENTRIES", DefaultSessionCacheMaxEntries),
+		},
+		Admin: AdminConfig{
+			AccountUUIDs: source.list("ADMIN_ACCOUNT_UUIDS"),
+		},
+		Google: GoogleConfig{
+			ClientIDs: source.list("GOOGLE_CLIENT_IDS"),
+			JWKSURL:   source.withDefault("GOOGLE_JWKS_URL", GoogleJWKSURL),
+		},
+		OIDC: source.oidcProviders("OIDC_PROVIDERS"),
+		ProviderLink: ProviderLinkConfig{
+			Policy: source.withDefault("PROVIDER_LINK_POLICY", ProviderLinkPassword),
+		},
+		Password: PasswordConfig{
+			MinLength:          source.positiveInt("PASSWORD_MIN_LENGTH", DefaultPasswordMinLength),
+			MaxLength:          source.positiveInt("PASSWORD_MAX_LENGTH", DefaultPasswordMaxLength),
+			RequiredClasses:    source.list("PASSWORD_REQUIRED_CLASSES"),
+			MinScore:           source.intRange("PASSWORD_MIN_SCORE", DefaultPasswordMinScore, 0, 4),
+			ForbidPersonalInfo: source.bool("PASSWORD_FORBID_PERSONAL_INFO", true),
+			BreachedFile:       source.get("PASSWORD_BREACHED_FILE"),
+			HistorySize:        source.intRange("PASSWORD_HISTORY_SIZE", DefaultPasswordHistorySize, 0, 24),
+		},
+		Mail: source.mail(),
+	}
+
+	if appConfig.Password.MaxLength < appConfig.Password.MinLength {
+		configErrors.add("PASSWORD_MAX_LENGTH: %d is below PASSWORD_MIN_LENGTH %d", appConfig.Password.MaxLength, appConfig.Password.MinLength)
+	}
+	for _, class := range appConfig.Password.RequiredClasses {
+		if !containsAny(passwordClasses, class) {
+			configErrors.add("PASSWORD_REQUIRED_CLASSES: %q must be one of %s", class, strings.Join(passwordClasses, ", "))
+		}
+	}
+
+	if policy := appConfig.ProviderLink.Policy; policy != ProviderLinkPassword && policy != ProviderLinkAutoVerifiedEmail {
+		configErrors.add("PROVIDER_LINK_POLICY: %q must be %s or %s", policy, ProviderLinkPassword, ProviderLinkAutoVerifiedEmail)
+	}
+
+	for _, previousKey := range appConfig.JWT.PreviousKeys {
+		if previousKey.ID == appConfig.JWT.KeyID {
+			configErrors.add("JWT_PREVIOUS_KEYS: kid %q is also the active JWT_KID", previousKey.ID)
+		}
+	}
+
+	if appConfig.JWT.Secret != "" && len(appConfig.JWT.Secret) < MinJWTSecretLength {
+		configErrors.add("JWT_SECRET: must be at least %d characters", MinJWTSecretLength)
+	}
+
+	if len(configErrors.Problems) > 0 {
+		return nil, configErrors
+	}
+	return appConfig, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if errWrite := os.WriteFile(path, []byte(content), 0o600); errWrite != nil {
+		t.Fatal(errWrite)
+	}
+	return path
+}
+
+func TestReadConfigFileLists(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": `
+listenAddr: ":8080"
+google:
+  clientIDs:
+    - web.apps.googleusercontent.com
+    - ios.apps.googleusercontent.com
+admin:
+  accountUUIDs: [a1, a2]
+log:
+  redactFields: secret
+password:
+  minLength: 12
+`,
+		"config.toml": `
+listenAddr = ":8080"
+
+[google]
+clientIDs = ["web.apps.googleusercontent.com", "ios.apps.googleusercontent.com"]
+
+[admin]
+accountUUIDs = ["a1", "a2"]
+
+[log]
+redactFields = "secret"
+
+[password]
+minLength = 12
+`,
+	}
+
+	expected := map[string]string{
+		"LISTEN_ADDR":         ":8080",
+		"GOOGLE_CLIENT_IDS":   "web.apps.googleusercontent.com,ios.apps.googleusercontent.com",
+		"ADMIN_ACCOUNT_UUIDS": "a1,a2",
+		"LOG_REDACT_FIELDS":   "secret",
+		"PASSWORD_MIN_LENGTH": "12",
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			values, errRead := readConfigFile(writeConfigFile(t, name, content))
+			if errRead != nil {
+				t.Fatal(errRead)
+			}
+			for key, want := range expected {
+				if values[key] != want {
+					t.Errorf("%s = %q, want %q", key, values[key], want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadConfigFileRejectsNestedLists(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": "admin:\n  accountUUIDs:\n    - [a1, a2]\n",
+		"config.toml": "[admin]\naccountUUIDs = [[\"a1\", \"a2\"]]\n",
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			if _, errRead := readConfigFile(writeConfigFile(t, name, content)); errRead == nil {
+				t.Error("expected an error for a nested list")
+			}
+		})
+	}
+}
+
+func TestMailBackendIsRequired(t *testing.T) {
+	for backend, wantProblems := range map[string]int{"": 1, "memory": 1, MailBackendFile: 0} {
+		t.Run("backend "+backend, func(t *testing.T) {
+			t.Setenv("MAIL_BACKEND", backend)
+			t.Setenv("MAIL_FROM", "no-reply@example.com")
+			configErrors := &ConfigError{}
+			source := &configSource{file: map[string]string{}, errors: configErrors}
+
+			source.mail()
+			if len(configErrors.Problems) != wantProblems {
+				t.Fatalf("problems %q, want %d", configErrors.Problems, wantProblems)
+			}
+		})
+	}
+}
+
+func TestOIDCResponseMode(t *testing.T) {
+	cases := []struct {
+		provider     string
+		responseMode string
+		want         string
+		wantProblems int
+	}{
+		{provider: "apple", want: "form_post"},
+		{provider: "apple", responseMode: "query", want: "query"},
+		{provider: "corp", responseMode: "form_post", want: "form_post"},
+		{provider: "corp", responseMode: "fragment", want: "fragment", wantProblems: 1},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.provider+" "+testCase.responseMode, func(t *testing.T) {
+			prefix := oidcEnvPrefix(testCase.provider)
+			t.Setenv(prefix+"ISSUER", "https://issuer.example.com")
+			t.Setenv(prefix+"CLIENT_ID", "client")
+			t.Setenv(prefix+"REDIRECT_URL", "https://app.example.com/auth/"+testCase.provider+"/callback")
+			t.Setenv(prefix+"RESPONSE_MODE", testCase.responseMode)
+			configErrors := &ConfigError{}
+			source := &configSource{file: map[string]string{"OIDC_PROVIDERS": testCase.provider}, errors: configErrors}
+
+			providers := source.oidcProviders("OIDC_PROVIDERS")
+			if len(configErrors.Problems) != testCase.wantProblems {
+				t.Fatalf("problems %q, want %d", configErrors.Problems, testCase.wantProblems)
+			}
+			if providers[0].ResponseMode != testCase.want {
+				t.Fatalf("response mode %q, want %q", providers[0].ResponseMode, testCase.want)
+			}
+		})
+	}
+}
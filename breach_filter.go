@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const breachFilterMagic = "CUBLOOM1"
+
+var InvalidBreachFilter = errors.New("not a breached-password filter file")
+
+// BloomFilter is a Bloom filter over SHA-1 digests. Digests are already
+// uniformly distributed, so the k bit positions are derived from the digest
+// itself by double hashing instead of hashing again.
+type BloomFilter struct {
+	bits []uint64
+	m    uint64
+	k    uint32
+}
+
+// NewBloomFilter sizes a filter for n entries at the given false positive
+// rate.
+func NewBloomFilter(n uint64, falsePositiveRate float64) *BloomFilter {
+	if n == 0 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	k := uint32(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+	return &BloomFilter{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+func (f *BloomFilter) positions(digest [sha1.Size]byte, visit func(position uint64) bool) bool {
+	h1 := binary.BigEndian.Uint64(digest[0:8])
+	h2 := binary.BigEndian.Uint64(digest[8:16]) | 1
+	for i := uint64(0); i < uint64(f.k); i++ {
+		if !visit((h1 + i*h2) % f.m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *BloomFilter) Add(digest [sha1.Size]byte) {
+	f.positions(digest, func(position uint64) bool {
+		f.bits[position/64] |= 1 << (position % 64)
+		return true
+	})
+}
+
+func (f *BloomFilter) Contains(digest [sha1.Size]byte) bool {
+	return f.positions(digest, func(position uint64) bool {
+		return f.bits[position/64]&(1<<(position%64)) != 0
+	})
+}
+
+// WriteTo stores the filter as the magic, k, m and the bit array, all big
+// endian.
+func (f *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	buffered := bufio.NewWriter(w)
+	written := int64(0)
+
+	header := make([]byte, len(breachFilterMagic)+4+8)
+	copy(header, breachFilterMagic)
+	binary.BigEndian.PutUint32(header[len(breachFilterMagic):], f.k)
+	binary.BigEndian.PutUint64(header[len(breachFilterMagic)+4:], f.m)
+	n, errWrite := buffered.Write(header)
+	written += int64(n)
+	if errWrite != nil {
+		return written, errWrite
+	}
+
+	word := make([]byte, 8)
+	for _, bits := range f.bits {
+		binary.BigEndian.PutUint64(word, bits)
+		n, errWrite = buffered.Write(word)
+		written += int64(n)
+		if errWrite != nil {
+			return written, errWrite
+		}
+	}
+	return written, buffered.Flush()
+}
+
+// maxBloomHashes bounds k when reading a filter. NewBloomFilter picks about
+// 30 even at a one in a billion false positive rate.
+const maxBloomHashes = 64
+
+// ReadBloomFilter reads a filter written by WriteTo. size is the length of
+// the input in bytes; the header must describe exactly that many bytes of
+// bits, so a corrupt header cannot make it allocate more than the file holds.
+func ReadBloomFilter(r io.Reader, size int64) (*BloomFilter, error) {
+	buffered := bufio.NewReader(r)
+
+	header := make([]byte, len(breachFilterMagic)+4+8)
+	if _, errRead := io.ReadFull(buffered, header); errRead != nil {
+		return nil, errors.Join(InvalidBreachFilter, errRead)
+	}
+	if string(header[:len(breachFilterMagic)]) != breachFilterMagic {
+		return nil, InvalidBreachFilter
+	}
+
+	filter := &BloomFilter{
+		k: binary.BigEndian.Uint32(header[len(breachFilterMagic):]),
+		m: binary.BigEndian.Uint64(header[len(breachFilterMagic)+4:]),
+	}
+	if filter.k == 0 || filter.k > maxBloomHashes || filter.m == 0 {
+		return nil, InvalidBreachFilter
+	}
+	payload := size - int64(len(header))
+	if payload <= 0 || payload%8 != 0 || filter.m > uint64(payload)*8 || filter.m <= uint64(payload)*8-64 {
+		return nil, fmt.Errorf("%w: header describes %d bits, file has %d bytes", InvalidBreachFilter, filter.m, size)
+	}
+	words := uint64(payload) / 8
+
+	filter.bits = make([]uint64, words)
+	word := make([]byte, 8)
+	for i := range filter.bits {
+		if _, errRead := io.ReadFull(buffered, word); errRead != nil {
+			return nil, errors.Join(InvalidBreachFilter, errRead)
+		}
+		filter.bits[i] = binary.BigEndian.Uint64(word)
+	}
+	return filter, nil
+}
+
+// BreachedPasswords answers whether a password appears in a breach corpus,
+// offline, from a filter built by the build-breach-filter command. A Bloom
+// filter never misses a breached password but may flag a few clean ones, at
+// the false positive rate chosen when building it.
+type BreachedPasswords struct {
+	filter *BloomFilter
+}
+
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	file, errOpen := os.Open(path)
+	if errOpen != nil {
+		return nil, errOpen
+	}
+	defer file.Close()
+
+	info, errStat := file.Stat()
+	if errStat != nil {
+		return nil, errStat
+	}
+	filter, errRead := ReadBloomFilter(file, info.Size())
+	if errRead != nil {
+		return nil, fmt.Errorf("%s: %w", path, errRead)
+	}
+	return &BreachedPasswords{filter: filter}, nil
+}
+
+func (b *BreachedPasswords) Contains(password string) bool {
+	return b.filter.Contains(sha1.Sum([]byte(password)))
+}
+
+// parseHashLine reads one line of an HIBP-format dump: 40 hex characters,
+// optionally followed by :count. ok is false for blank or malformed lines.
+func parseHashLine(line string) (digest [sha1.Size]byte, count int, ok bool) {
+	line = strings.TrimSpace(line)
+	hash, rawCount, hasCount := strings.Cut(line, ":")
+	if len(hash) != sha1.Size*2 {
+		return digest, 0, false
+	}
+	if _, errDecode := hex.Decode(digest[:], []byte(hash)); errDecode != nil {
+		return digest, 0, false
+	}
+
+	count = 1
+	if hasCount {
+		parsed, errCount := strconv.Atoi(rawCount)
+		if errCount != nil {
+			return digest, 0, false
+		}
+		count = parsed
+	}
+	return digest, count, true
+}
+
+// BuildBreachFilter reads an HIBP-format SHA-1 dump from inPath and writes a
+// filter to outPath, skipping hashes seen fewer than minCount times. The
+// dump is read twice: once to size the filter, once to fill it.
+func BuildBreachFilter(inPath string, outPath string, falsePositiveRate float64, minCount int) (uint64, error) {
+	scanDump := func(visit func(digest [sha1.Size]byte)) (uint64, error) {
+		file, errOpen := os.Open(inPath)
+		if errOpen != nil {
+			return 0, errOpen
+		}
+		defer file.Close()
+
+		entries := uint64(0)
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			digest, count, ok := parseHashLine(scanner.Text())
+			if !ok || count < minCount {
+				continue
+			}
+			visit(digest)
+			entries++
+		}
+		return entries, scanner.Err()
+	}
+
+	entries, errCount := scanDump(func([sha1.Size]byte) {})
+	if errCount != nil {
+		return 0, errCount
+	}
+
+	filter := NewBloomFilter(entries, falsePositiveRate)
+	if _, errFill := scanDump(filter.Add); errFill != nil {
+		return 0, errFill
+	}
+
+	out, errCreate := os.Create(outPath)
+	if errCreate != nil {
+		return 0, errCreate
+	}
+	if _, errWrite := filter.WriteTo(out); errWrite != nil {
+		out.Close()
+		return 0, errWrite
+	}
+	return entries, out.Close()
+}
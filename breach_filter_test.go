@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func sha1Line(password string, count int) string {
+	digest := sha1.Sum([]byte(password))
+	return fmt.Sprintf("%s:%d", strings.ToUpper(hex.EncodeToString(digest[:])), count)
+}
+
+func TestBuildBreachFilter(t *testing.T) {
+	directory := t.TempDir()
+	dump := filepath.Join(directory, "dump.txt")
+	lines := []string{
+		sha1Line("password", 9545824),
+		sha1Line("123456", 37359195),
+		sha1Line("rarely-seen", 1),
+		"",
+		"not a hash",
+	}
+	if errWrite := os.WriteFile(dump, []byte(strings.Join(lines, "\n")), 0o600); errWrite != nil {
+		t.Fatal(errWrite)
+	}
+
+	filterPath := filepath.Join(directory, "breached.bloom")
+	entries, errBuild := BuildBreachFilter(dump, filterPath, 0.0001, 2)
+	if errBuild != nil {
+		t.Fatal(errBuild)
+	}
+	if entries != 2 {
+		t.Fatalf("%d entries, want 2", entries)
+	}
+
+	breached, errLoad := LoadBreachedPasswords(filterPath)
+	if errLoad != nil {
+		t.Fatal(errLoad)
+	}
+
+	cases := []struct {
+		password string
+		want     bool
+	}{
+		{password: "password", want: true},
+		{password: "123456", want: true},
+		{password: "rarely-seen", want: false},
+		{password: "correct horse battery staple", want: false},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.password, func(t *testing.T) {
+			if got := breached.Contains(testCase.password); got != testCase.want {
+				t.Fatalf("Contains = %v, want %v", got, testCase.want)
+			}
+		})
+	}
+}
+
+func TestBloomFilterRoundTrip(t *testing.T) {
+	filter := NewBloomFilter(1000, 0.001)
+	for i := 0; i < 1000; i++ {
+		filter.Add(sha1.Sum([]byte(fmt.Sprint("breached-", i))))
+	}
+
+	var encoded bytes.Buffer
+	if _, errWrite := filter.WriteTo(&encoded); errWrite != nil {
+		t.Fatal(errWrite)
+	}
+	size := int64(encoded.Len())
+	read, errRead := ReadBloomFilter(&encoded, size)
+	if errRead != nil {
+		t.Fatal(errRead)
+	}
+	if read.m != filter.m || read.k != filter.k || len(read.bits) != len(filter.bits) {
+		t.Fatalf("read m=%d k=%d, wrote m=%d k=%d", read.m, read.k, filter.m, filter.k)
+	}
+
+	// a Bloom filter never misses a member
+	for i := 0; i < 1000; i++ {
+		if !read.Contains(sha1.Sum([]byte(fmt.Sprint("breached-", i)))) {
+			t.Fatalf("breached-%d missing after the round trip", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if read.Contains(sha1.Sum([]byte(fmt.Sprint("clean-", i)))) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Fatalf("%d false positives in 10000, want about 10", falsePositives)
+	}
+}
+
+func TestReadBloomFilterRejectsCorruptFiles(t *testing.T) {
+	var valid bytes.Buffer
+	if _, errWrite := NewBloomFilter(100, 0.01).WriteTo(&valid); errWrite != nil {
+		t.Fatal(errWrite)
+	}
+	withHeader := func(k uint32, m uint64) []byte {
+		encoded := bytes.Clone(valid.Bytes())
+		binary.BigEndian.PutUint32(encoded[len(breachFilterMagic):], k)
+		binary.BigEndian.PutUint64(encoded[len(breachFilterMagic)+4:], m)
+		return encoded
+	}
+
+	cases := []struct {
+		name    string
+		encoded []byte
+	}{
+		{name: "empty", encoded: nil},
+		{name: "short header", encoded: valid.Bytes()[:10]},
+		{name: "wrong magic", encoded: append([]byte("NOTBLOOM"), valid.Bytes()[8:]...)},
+		{name: "zero hashes", encoded: withHeader(0, 959)},
+		{name: "too many hashes", encoded: withHeader(1000, 959)},
+		{name: "zero bits", encoded: withHeader(7, 0)},
+		{name: "huge bit count", encoded: withHeader(7, 1<<62)},
+		{name: "overflowing bit count", encoded: withHeader(7, ^uint64(0))},
+		{name: "truncated bits", encoded: valid.Bytes()[:valid.Len()-8]},
+		{name: "trailing bytes", encoded: append(bytes.Clone(valid.Bytes()), 0, 0, 0, 0, 0, 0, 0, 0)},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, errRead := ReadBloomFilter(bytes.NewReader(testCase.encoded), int64(len(testCase.encoded)))
+			if !errors.Is(errRead, InvalidBreachFilter) {
+				t.Fatalf("error %v, want InvalidBreachFilter", errRead)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// commands are the maintenance subcommands, run as `<binary> <command>
+// [flags]` instead of starting the server.
+var commands = map[string]func(args []string) error{
+	"build-breach-filter":   buildBreachFilterCommand,
+	"render-email-previews": renderEmailPreviewsCommand,
+}
+
+func runCommand(name string, args []string) error {
+	command, found := commands[name]
+	if !found {
+		return fmt.Errorf("unknown command %q", name)
+	}
+	return command(args)
+}
+
+func buildBreachFilterCommand(args []string) error {
+	flags := flag.NewFlagSet("build-breach-filter", flag.ContinueOnError)
+	in := flags.String("in", "", "HIBP-format SHA-1 dump, one HASH[:count] per line")
+	out := flags.String("out", "breached-passwords.bloom", "filter file to write")
+	falsePositiveRate := flags.Float64("fp", 0.001, "false positive rate")
+	minCount := flags.Int("min-count", 1, "skip hashes seen fewer times than this")
+	if errParse := flags.Parse(args); errParse != nil {
+		return errParse
+	}
+
+	if *in == "" {
+		return fmt.Errorf("build-breach-filter: -in is required")
+	}
+	if *falsePositiveRate <= 0 || *falsePositiveRate >= 1 {
+		return fmt.Errorf("build-breach-filter: -fp must be between 0 and 1")
+	}
+
+	entries, errBuild := BuildBreachFilter(*in, *out, *falsePositiveRate, *minCount)
+	if errBuild != nil {
+		return errBuild
+	}
+
+	fmt.Fprintf(os.Stdout, "wrote %s with %d hashes\n", *out, entries)
+	return nil
+}
+
+// renderEmailPreviewsCommand renders every email kind in every language with
+// sample data, as <out>/<language>/<kind>.txt, .html and .eml, so template
+// changes can be reviewed in a browser or a mail client.
+func renderEmailPreviewsCommand(args []string) error {
+	flags := flag.NewFlagSet("render-email-previews", flag.ContinueOnError)
+	out := flags.String("out", "email-previews", "directory to write the previews to")
+	product := flags.String("product", DefaultMailProductName, "product name used in the emails")
+	from := flags.String("from", "no-reply@example.com", "sender of the .eml previews")
+	if errParse := flags.Parse(args); errParse != nil {
+		return errParse
+	}
+
+	emailTemplates, errLoad := LoadEmailTemplates(*product)
+	if errLoad != nil {
+		return errLoad
+	}
+
+	sample := EmailData{
+		Name:        "Ada Lovelace",
+		NewEmail:    "ada.new@example.com",
+		AccountUUID: "3f0c6a52-8d1e-4b7a-9c2f-5e4d1a6b7c8d",
+		Code:        "Z7Q4K2",
+		Device:      "web Mozilla/5.0 (Macintosh; Intel Mac OS X 14_5) Firefox/128.0",
+		IPAddress:   "203.0.113.42",
+		Time:        time.Date(2024, time.March, 14, 9, 26, 0, 0, time.UTC),
+	}
+
+	written := 0
+	for _, language := range SupportedLanguages {
+		directory := filepath.Join(*out, language)
+		if errMkdir := os.MkdirAll(directory, 0o755); errMkdir != nil {
+			return errMkdir
+		}
+
+		for _, kind := range EmailKinds {
+			message, errRender := emailTemplates.Render(kind, language, "ada@example.com", sample)
+			if errRender != nil {
+				return fmt.Errorf("%s/%s: %w", language, kind, errRender)
+			}
+			eml, errEml := message.rfc822(*from)
+			if errEml != nil {
+				return errEml
+			}
+
+			files := map[string][]byte{
+				kind + ".txt":  []byte("Subject: " + message.Subject + "\n\n" + message.Text),
+				kind + ".html": []byte(message.HTML),
+				kind + ".eml":  eml,
+			}
+			for name, content := range files {
+				if errWrite := os.WriteFile(filepath.Join(directory, name), content, 0o644); errWrite != nil {
+					return errWrite
+				}
+			}
+			written++
+		}
+	}
+
+	fmt.Fprintf(os.Stdout, "wrote %d previews to %s\n", written, *out)
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+const (
+	EmailVerification       = "verification"
+	EmailChangeConfirm      = "email-change-confirm"
+	EmailChangeRevoke       = "email-change-revoke"
+	EmailPasswordReset      = "password-reset"
+	EmailPasswordSet        = "password-set"
+	EmailNewLogin           = "new-login"
+	emailTemplatesDirectory = "email_templates"
+)
+
+var EmailKinds = []string{EmailVerification, EmailChangeConfirm, EmailChangeRevoke, EmailPasswordReset, EmailPasswordSet, EmailNewLogin}
+
+// emailTemplateFiles holds email_templates/<language>/<kind>.txt and .html
+// for every kind in EmailKinds and every language in SupportedLanguages. The
+// .txt template defines "subject" and is the plain text body; the .html one
+// defines "content", rendered inside the language's layout.html.
+//
+//go:embed email_templates
+var emailTemplateFiles embed.FS
+
+// EmailData is what the templates can use. Code holds the verification code
+// or token of the message, Email the address the message is sent to except
+// for EmailChangeRevoke, which goes to Email and mentions NewEmail.
+type EmailData struct {
+	Product     string
+	Name        string
+	Email       string
+	NewEmail    string
+	AccountUUID string
+	Code        string
+	Device      string
+	IPAddress   string
+	Time        time.Time
+}
+
+type emailTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// EmailTemplates renders the transactional emails in the recipient's
+// language.
+type EmailTemplates struct {
+	product   string
+	templates map[string]map[string]emailTemplate
+}
+
+// LoadEmailTemplates parses every template up front, so a missing language
+// variant or a broken template stops the server at startup instead of
+// failing to send a mail later.
+func LoadEmailTemplates(product string) (*EmailTemplates, error) {
+	emailTemplates := &EmailTemplates{product: product, templates: map[string]map[string]emailTemplate{}}
+
+	for _, language := range SupportedLanguages {
+		directory := emailTemplatesDirectory + "/" + language
+		layout, errLayout := htmltemplate.ParseFS(emailTemplateFiles, directory+"/layout.html")
+		if errLayout != nil {
+			return nil, errLayout
+		}
+
+		emailTemplates.templates[language] = map[string]emailTemplate{}
+		for _, kind := range EmailKinds {
+			text, errText := texttemplate.ParseFS(emailTemplateFiles, directory+"/"+kind+".txt")
+			if errText != nil {
+				return nil, errText
+			}
+			if text.Lookup("subject") == nil {
+				return nil, fmt.Errorf("%s/%s.txt: no subject defined", directory, kind)
+			}
+
+			html, errClone := layout.Clone()
+			if errClone != nil {
+				return nil, errClone
+			}
+			if _, errHTML := html.ParseFS(emailTemplateFiles, directory+"/"+kind+".html"); errHTML != nil {
+				return nil, errHTML
+			}
+
+			emailTemplates.templates[language][kind] = emailTemplate{text: text, html: html}
+		}
+	}
+	return emailTemplates, nil
+}
+
+// Render builds the message of the given kind for to, in language or in
+// DefaultLanguage when there is no variant for it.
+func (t *EmailTemplates) Render(kind string, language string, to string, data EmailData) (Message, error) {
+	variants, found := t.templates[language]
+	if !found {
+		variants = t.templates[DefaultLanguage]
+	}
+	kindTemplate, found := variants[kind]
+	if !found {
+		return Message{}, fmt.Errorf("unknown email kind %q", kind)
+	}
+
+	data.Product = t.product
+	if data.Email == "" {
+		data.Email = to
+	}
+
+	var subject, text, html bytes.Buffer
+	if errSubject := kindTemplate.text.ExecuteTemplate(&subject, "subject", data); errSubject != nil {
+		return Message{}, errSubject
+	}
+	if errText := kindTemplate.text.Execute(&text, data); errText != nil {
+		return Message{}, errText
+	}
+	if errHTML := kindTemplate.html.Execute(&html, data); errHTML != nil {
+		return Message{}, errHTML
+	}
+
+	return Message{
+		To:      to,
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
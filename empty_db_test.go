@@ -0,0 +1,48 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+)
+
+// emptyDB is a database/sql driver whose every query returns no rows and
+// whose every statement affects none, for code that reads a table the test
+// leaves empty.
+type emptyDB struct{}
+
+func (emptyDB) Open(name string) (driver.Conn, error) { return emptyConn{}, nil }
+
+type emptyConn struct{}
+
+func (emptyConn) Prepare(query string) (driver.Stmt, error) { return emptyStmt{}, nil }
+func (emptyConn) Close() error                              { return nil }
+func (emptyConn) Begin() (driver.Tx, error)                 { return nil, errors.New("no transactions") }
+
+type emptyStmt struct{}
+
+func (emptyStmt) Close() error                                    { return nil }
+func (emptyStmt) NumInput() int                                   { return -1 }
+func (emptyStmt) Exec(args []driver.Value) (driver.Result, error) { return driver.RowsAffected(0), nil }
+func (emptyStmt) Query(args []driver.Value) (driver.Rows, error)  { return emptyRows{}, nil }
+
+type emptyRows struct{}
+
+func (emptyRows) Columns() []string              { return []string{"value"} }
+func (emptyRows) Close() error                   { return nil }
+func (emptyRows) Next(dest []driver.Value) error { return io.EOF }
+
+func init() {
+	sql.Register("empty", emptyDB{})
+}
+
+func newEmptyDB(t *testing.T) *sql.DB {
+	db, errOpen := sql.Open("empty", "")
+	if errOpen != nil {
+		t.Fatal(errOpen)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
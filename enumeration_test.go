@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"github.com/21strive/commonuser/account"
+	"github.com/gofiber/fiber/v2"
+	"github.com/matthewhartstonge/argon2"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// countPasswordChecks swaps verifyPassword for a counting wrapper for the
+// rest of the test.
+func countPasswordChecks(t *testing.T) *int {
+	checks := 0
+	verify := verifyPassword
+	verifyPassword = func(password []byte, hash []byte) (bool, error) {
+		checks++
+		return verify(password, hash)
+	}
+	t.Cleanup(func() { verifyPassword = verify })
+	return &checks
+}
+
+func TestRejectLoginEvensThePasswordChecks(t *testing.T) {
+	hasher := argon2.DefaultConfig()
+	hash, errHash := hasher.HashEncoded([]byte("correct-password"))
+	if errHash != nil {
+		t.Fatal(errHash)
+	}
+	withPassword := account.New()
+	withPassword.SetPassword(string(hash))
+
+	cases := []struct {
+		name string
+		// libraryChecks is the argon2 work the library login did before failing
+		libraryChecks int
+		found         *account.Account
+		errFind       error
+		wantStatus    int
+	}{
+		{name: "unknown account", found: nil, errFind: account.NotFound, wantStatus: http.StatusUnauthorized},
+		{name: "account without password", found: account.New(), wantStatus: http.StatusUnauthorized},
+		{name: "wrong password", libraryChecks: 1, found: withPassword, wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			checks := countPasswordChecks(t)
+			app := fiber.New()
+			app.Post("/login", func(c *fiber.Ctx) error {
+				return (&HTTPHandler{}).rejectLogin(c, errors.New("login failed"), func() (*account.Account, error) {
+					return testCase.found, testCase.errFind
+				}, "wrong-password")
+			})
+
+			response, errTest := app.Test(httptest.NewRequest(http.MethodPost, "/login", nil), -1)
+			if errTest != nil {
+				t.Fatal(errTest)
+			}
+			if response.StatusCode != testCase.wantStatus {
+				t.Fatalf("status %d, want %d", response.StatusCode, testCase.wantStatus)
+			}
+			if total := testCase.libraryChecks + *checks; total != 2 {
+				t.Fatalf("%d argon2 checks in all, want 2", total)
+			}
+		})
+	}
+}
+
+func TestRejectLoginOtherFailuresAreServerErrors(t *testing.T) {
+	app := fiber.New()
+	app.Post("/login", func(c *fiber.Ctx) error {
+		return (&HTTPHandler{}).rejectLogin(c, errors.New("connection refused"), func() (*account.Account, error) {
+			return nil, errors.New("connection refused")
+		}, "password")
+	})
+
+	response, errTest := app.Test(httptest.NewRequest(http.MethodPost, "/login", nil), -1)
+	if errTest != nil {
+		t.Fatal(errTest)
+	}
+	if response.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("status %d, want 500", response.StatusCode)
+	}
+}
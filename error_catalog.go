@@ -0,0 +1,221 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"net/http"
+)
+
+const DefaultLanguage = "en"
+
+// CatalogEntry describes one error code returned to clients. Codes are part
+// of the public API: clients branch on them, so never rename or reuse one.
+type CatalogEntry struct {
+	Code   string
+	Status int
+	Title  string
+	Detail map[string]string
+}
+
+// ErrorDocsBaseURL, when set, turns every problem "type" into a link to the
+// code's documentation page. Otherwise "about:blank" is used per RFC 7807.
+var ErrorDocsBaseURL string
+
+var ErrorCatalog = map[string]CatalogEntry{}
+
+// SupportedLanguages lists the languages every catalog entry provides a
+// detail text for, in order of preference.
+var SupportedLanguages = []string{DefaultLanguage, "id"}
+
+func catalog(code string, status int, title string, detail map[string]string) {
+	ErrorCatalog[code] = CatalogEntry{Code: code, Status: status, Title: title, Detail: detail}
+}
+
+func init() {
+	catalog("invalid-request", fiber.StatusBadRequest, "Invalid request", map[string]string{
+		"en": "The request could not be processed.",
+		"id": "Permintaan tidak dapat diproses.",
+	})
+	catalog("invalid-request-body", fiber.StatusBadRequest, "Invalid request body", map[string]string{
+		"en": "The request body is missing or is not valid JSON for this endpoint.",
+		"id": "Isi permintaan kosong atau bukan JSON yang valid untuk endpoint ini.",
+	})
+	catalog("validation-failed", fiber.StatusBadRequest, "Validation failed", map[string]string{
+		"en": "Some fields are missing or invalid. See errors for each field.",
+		"id": "Beberapa isian kosong atau tidak valid. Lihat errors untuk setiap isian.",
+	})
+	catalog("password-policy", fiber.StatusBadRequest, "Password too weak", map[string]string{
+		"en": "The password does not meet the password policy. See errors for the failed rules.",
+		"id": "Kata sandi tidak memenuhi kebijakan kata sandi. Lihat errors untuk aturan yang gagal.",
+	})
+	catalog("missing-authorization", fiber.StatusUnauthorized, "Missing authorization", map[string]string{
+		"en": "The Authorization header is required.",
+		"id": "Header Authorization wajib diisi.",
+	})
+	catalog("invalid-authorization", fiber.StatusUnauthorized, "Invalid authorization", map[string]string{
+		"en": "The Authorization header must use the Bearer scheme.",
+		"id": "Header Authorization harus menggunakan skema Bearer.",
+	})
+	catalog("invalid-credentials", fiber.StatusUnauthorized, "Invalid credentials", map[string]string{
+		"en": "The login or password is incorrect.",
+		"id": "Login atau kata sandi salah.",
+	})
+	catalog("invalid-token", fiber.StatusUnauthorized, "Invalid access token", map[string]string{
+		"en": "The access token is expired, malformed or signed by an unknown key.",
+		"id": "Access token kedaluwarsa, tidak valid, atau ditandatangani oleh kunci yang tidak dikenal.",
+	})
+	catalog("session-revoked", fiber.StatusUnauthorized, "Session revoked", map[string]string{
+		"en": "This session has been signed out. Please sign in again.",
+		"id": "Sesi ini telah diakhiri. Silakan masuk kembali.",
+	})
+	catalog("missing-refresh-token", fiber.StatusUnauthorized, "Missing refresh token", map[string]string{
+		"en": "The refreshToken cookie is required.",
+		"id": "Cookie refreshToken wajib ada.",
+	})
+	catalog("invalid-refresh-token", fiber.StatusUnauthorized, "Invalid refresh token", map[string]string{
+		"en": "The refresh token is unknown, expired or already used. Please sign in again.",
+		"id": "Refresh token tidak dikenal, kedaluwarsa, atau sudah digunakan. Silakan masuk kembali.",
+	})
+	catalog("refresh-token-reused", fiber.StatusUnauthorized, "Refresh token reused", map[string]string{
+		"en": "This refresh token was already used. The session has been signed out for your safety; please sign in again.",
+		"id": "Refresh token ini sudah pernah digunakan. Sesi telah diakhiri demi keamanan Anda; silakan masuk kembali.",
+	})
+	catalog("invalid-verification-code", fiber.StatusUnauthorized, "Invalid verification code", map[string]string{
+		"en": "The verification code is wrong or has expired.",
+		"id": "Kode verifikasi salah atau sudah kedaluwarsa.",
+	})
+	catalog("invalid-reset-token", fiber.StatusBadRequest, "Invalid reset token", map[string]string{
+		"en": "The password reset link is wrong, expired or already used. Request a new one.",
+		"id": "Tautan atur ulang kata sandi salah, sudah kedaluwarsa, atau sudah digunakan. Minta tautan baru.",
+	})
+	catalog("invalid-email-update-token", fiber.StatusBadRequest, "Invalid email change token", map[string]string{
+		"en": "The email change link is wrong, expired or already used.",
+		"id": "Tautan perubahan email salah, sudah kedaluwarsa, atau sudah digunakan.",
+	})
+	catalog("invalid-id-token", fiber.StatusUnauthorized, "Invalid ID token", map[string]string{
+		"en": "The identity provider token could not be verified.",
+		"id": "Token dari penyedia identitas tidak dapat diverifikasi.",
+	})
+	catalog("email-not-verified", fiber.StatusForbidden, "Email not verified", map[string]string{
+		"en": "The identity provider has not verified this email address.",
+		"id": "Penyedia identitas belum memverifikasi alamat email ini.",
+	})
+	catalog("invalid-oidc-state", fiber.StatusBadRequest, "Invalid login state", map[string]string{
+		"en": "The login attempt expired or was already used. Start the login again.",
+		"id": "Percobaan masuk sudah kedaluwarsa atau sudah digunakan. Mulai ulang proses masuk.",
+	})
+	catalog("oidc-exchange-failed", fiber.StatusBadGateway, "Identity provider error", map[string]string{
+		"en": "The identity provider did not accept the login. Try again later.",
+		"id": "Penyedia identitas tidak menerima proses masuk. Coba lagi nanti.",
+	})
+	catalog("invalid-link-token", fiber.StatusBadRequest, "Invalid link token", map[string]string{
+		"en": "The account link request expired or was already used. Sign in with the provider again.",
+		"id": "Permintaan penautan akun sudah kedaluwarsa atau sudah digunakan. Masuk kembali dengan penyedia.",
+	})
+	catalog("invalid-link-password", fiber.StatusUnauthorized, "Link not confirmed", map[string]string{
+		"en": "The password is incorrect. Sign in with the provider again to retry.",
+		"id": "Kata sandi salah. Masuk kembali dengan penyedia untuk mencoba lagi.",
+	})
+	catalog("provider-already-linked", fiber.StatusConflict, "Provider already linked", map[string]string{
+		"en": "This provider account is already linked to another account.",
+		"id": "Akun penyedia ini sudah terhubung ke akun lain.",
+	})
+	catalog("last-login-method", fiber.StatusConflict, "Last login method", map[string]string{
+		"en": "This is your only way to sign in. Set a password before unlinking it.",
+		"id": "Ini satu-satunya cara Anda untuk masuk. Atur kata sandi sebelum melepaskannya.",
+	})
+	catalog("password-already-set", fiber.StatusConflict, "Password already set", map[string]string{
+		"en": "This account already has a password. Use the password update instead.",
+		"id": "Akun ini sudah memiliki kata sandi. Gunakan fitur ubah kata sandi.",
+	})
+	catalog("email-required", fiber.StatusConflict, "Email required", map[string]string{
+		"en": "This account has no email address to send the token to.",
+		"id": "Akun ini tidak memiliki alamat email untuk menerima token.",
+	})
+	catalog("reauthentication-required", fiber.StatusForbidden, "Reauthentication required", map[string]string{
+		"en": "Sign in with your provider again, or use the emailed token, to continue.",
+		"id": "Masuk kembali dengan penyedia Anda, atau gunakan token dari email, untuk melanjutkan.",
+	})
+	catalog("unauthorized", fiber.StatusUnauthorized, "Unauthorized", map[string]string{
+		"en": "Authentication is required to access this resource.",
+		"id": "Autentikasi diperlukan untuk mengakses sumber ini.",
+	})
+	catalog("forbidden", fiber.StatusForbidden, "Forbidden", map[string]string{
+		"en": "You are not allowed to perform this action.",
+		"id": "Anda tidak diizinkan melakukan tindakan ini.",
+	})
+	catalog("not-found", fiber.StatusNotFound, "Not found", map[string]string{
+		"en": "The requested resource does not exist.",
+		"id": "Sumber yang diminta tidak ditemukan.",
+	})
+	catalog("account-not-found", fiber.StatusNotFound, "Account not found", map[string]string{
+		"en": "No account matches the given identifier.",
+		"id": "Tidak ada akun yang cocok dengan pengenal tersebut.",
+	})
+	catalog("provider-not-found", fiber.StatusNotFound, "Provider not found", map[string]string{
+		"en": "No identity provider is linked for the given subject.",
+		"id": "Tidak ada penyedia identitas yang terhubung untuk subjek tersebut.",
+	})
+	catalog("oidc-provider-not-found", fiber.StatusNotFound, "Login provider not found", map[string]string{
+		"en": "No login provider with this name is configured.",
+		"id": "Tidak ada penyedia login dengan nama ini yang dikonfigurasi.",
+	})
+	catalog("session-not-found", fiber.StatusNotFound, "Session not found", map[string]string{
+		"en": "No session with this id exists for your account.",
+		"id": "Tidak ada sesi dengan id ini pada akun Anda.",
+	})
+	catalog("method-not-allowed", fiber.StatusMethodNotAllowed, "Method not allowed", map[string]string{
+		"en": "This endpoint does not support the HTTP method used.",
+		"id": "Endpoint ini tidak mendukung metode HTTP yang digunakan.",
+	})
+	catalog("request-too-large", fiber.StatusRequestEntityTooLarge, "Request too large", map[string]string{
+		"en": "The request body exceeds the allowed size.",
+		"id": "Ukuran isi permintaan melebihi batas yang diizinkan.",
+	})
+	catalog("too-many-requests", fiber.StatusTooManyRequests, "Too many requests", map[string]string{
+		"en": "Too many requests, please retry later.",
+		"id": "Terlalu banyak permintaan, silakan coba lagi nanti.",
+	})
+	catalog("request-error", fiber.StatusBadRequest, "Request error", map[string]string{
+		"en": "The request could not be completed.",
+		"id": "Permintaan tidak dapat diselesaikan.",
+	})
+	catalog("failed-revoke", fiber.StatusInternalServerError, "Revocation failed", map[string]string{
+		"en": "The email update could not be revoked.",
+		"id": "Perubahan email tidak dapat dibatalkan.",
+	})
+	catalog("session-seed-required", fiber.StatusServiceUnavailable, "Session cache not ready", map[string]string{
+		"en": "Session data is being rebuilt, please retry shortly.",
+		"id": "Data sesi sedang dibangun ulang, silakan coba lagi sebentar lagi.",
+	})
+	catalog("internal-server-error", fiber.StatusInternalServerError, "Internal server error", map[string]string{
+		"en": "An unexpected error occurred. Quote the error id when contacting support.",
+		"id": "Terjadi kesalahan tak terduga. Sertakan id kesalahan saat menghubungi dukungan.",
+	})
+}
+
+// LookupCatalog returns the entry for code. Unknown codes fall back to a
+// generic entry built from the HTTP status so a response is always complete.
+func LookupCatalog(code string, status int) CatalogEntry {
+	if entry, found := ErrorCatalog[code]; found {
+		return entry
+	}
+	return CatalogEntry{Code: code, Status: status, Title: http.StatusText(status)}
+}
+
+func (e CatalogEntry) Type() string {
+	if ErrorDocsBaseURL == "" {
+		return "about:blank"
+	}
+	return ErrorDocsBaseURL + e.Code
+}
+
+// LocalizedDetail picks the detail text for the best language in the
+// request's Accept-Language header, falling back to DefaultLanguage.
+func (e CatalogEntry) LocalizedDetail(c *fiber.Ctx) string {
+	if language := c.AcceptsLanguages(SupportedLanguages...); language != "" {
+		if detail, found := e.Detail[language]; found {
+			return detail
+		}
+	}
+	return e.Detail[DefaultLanguage]
+}
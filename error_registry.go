@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/21strive/commonuser/account"
+	"github.com/21strive/commonuser/provider"
+	"github.com/21strive/commonuser/session"
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"net"
+	"sync"
+)
+
+// Errors for commonuser calls that check what the caller sent but fail
+// without a sentinel of their own. blameCaller attaches them.
+var (
+	WrongPassword           = errors.New("password does not match")
+	InvalidResetToken       = errors.New("reset token wrong, expired or used")
+	InvalidEmailUpdateToken = errors.New("email update token wrong, expired or used")
+)
+
+type ErrorMapping struct {
+	Status int
+	Code   string
+}
+
+type registeredError struct {
+	target  error
+	mapping ErrorMapping
+}
+
+// ErrorRegistry maps sentinel errors to the status and code returned to the
+// client. Lookups use errors.Is, so wrapped errors resolve too; the first
+// registered match wins.
+type ErrorRegistry struct {
+	mu      sync.RWMutex
+	entries []registeredError
+}
+
+func NewErrorRegistry() *ErrorRegistry {
+	return &ErrorRegistry{}
+}
+
+func (r *ErrorRegistry) Register(target error, status int, code string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, registeredError{target: target, mapping: ErrorMapping{Status: status, Code: code}})
+}
+
+func (r *ErrorRegistry) Lookup(err error) (ErrorMapping, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, entry := range r.entries {
+		if errors.Is(err, entry.target) {
+			return entry.mapping, true
+		}
+	}
+	return ErrorMapping{}, false
+}
+
+var Errors = defaultErrorRegistry()
+
+func defaultErrorRegistry() *ErrorRegistry {
+	registry := NewErrorRegistry()
+	registry.Register(account.NotFound, fiber.StatusNotFound, "account-not-found")
+	registry.Register(provider.ProviderNotFound, fiber.StatusNotFound, "provider-not-found")
+	registry.Register(OIDCProviderNotFound, fiber.StatusNotFound, "oidc-provider-not-found")
+	registry.Register(OIDCStateNotFound, fiber.StatusBadRequest, "invalid-oidc-state")
+	registry.Register(OIDCExchangeFailed, fiber.StatusBadGateway, "oidc-exchange-failed")
+	registry.Register(PendingLinkNotFound, fiber.StatusBadRequest, "invalid-link-token")
+	registry.Register(ProviderLinkedToOther, fiber.StatusConflict, "provider-already-linked")
+	registry.Register(LastLoginMethod, fiber.StatusConflict, "last-login-method")
+	registry.Register(PasswordAlreadySet, fiber.StatusConflict, "password-already-set")
+	registry.Register(WrongPassword, fiber.StatusUnauthorized, "invalid-credentials")
+	registry.Register(InvalidResetToken, fiber.StatusBadRequest, "invalid-reset-token")
+	registry.Register(InvalidEmailUpdateToken, fiber.StatusBadRequest, "invalid-email-update-token")
+	registry.Register(session.SeedRequired, fiber.StatusServiceUnavailable, "session-seed-required")
+	registry.Register(sql.ErrNoRows, fiber.StatusNotFound, "not-found")
+	registry.Register(UnknownSigningKey, fiber.StatusUnauthorized, "invalid-token")
+	registry.Register(RetiredSigningKey, fiber.StatusUnauthorized, "invalid-token")
+	registry.Register(SigningMethodMismatch, fiber.StatusUnauthorized, "invalid-token")
+	registry.Register(MissingKeyID, fiber.StatusUnauthorized, "invalid-token")
+	return registry
+}
+
+// blameCaller marks err, returned by a commonuser call that checks a password
+// or token the caller sent, with sentinel: short of the database, Redis or
+// the network failing, the input was what the call rejected. Infrastructure
+// failures are returned unchanged and stay a 500.
+func blameCaller(err error, sentinel error) error {
+	if err == nil || infrastructureError(err) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", sentinel, err)
+}
+
+func infrastructureError(err error) bool {
+	var pqError *pq.Error
+	var netError net.Error
+	var redisError redis.Error
+	switch {
+	case errors.As(err, &pqError), errors.As(err, &netError):
+		return true
+	case errors.As(err, &redisError) && !errors.Is(err, redis.Nil):
+		return true
+	}
+	for _, target := range []error{driver.ErrBadConn, sql.ErrConnDone, sql.ErrTxDone, redis.ErrClosed,
+		context.Canceled, context.DeadlineExceeded, io.EOF, io.ErrUnexpectedEOF} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrorHandler is installed as fiber.Config.ErrorHandler so that every error
+// a handler returns gets the same ServiceError body and log line as the ones
+// built explicitly with ErrorResponse.
+func ErrorHandler(c *fiber.Ctx, err error) error {
+	source := "ErrorHandler." + c.Route().Path
+
+	if mapping, found := Errors.Lookup(err); found {
+		return ErrorResponse(c, mapping.Status, err, mapping.Code, source)
+	}
+
+	var fiberError *fiber.Error
+	if errors.As(err, &fiberError) {
+		return ErrorResponse(c, fiberError.Code, err, httpErrorCode(fiberError.Code), source)
+	}
+
+	return ErrorResponse(c, fiber.StatusInternalServerError, err, "internal-server-error", source)
+}
+
+func httpErrorCode(status int) string {
+	switch status {
+	case fiber.StatusBadRequest:
+		return "invalid-request"
+	case fiber.StatusUnauthorized:
+		return "unauthorized"
+	case fiber.StatusForbidden:
+		return "forbidden"
+	case fiber.StatusNotFound:
+		return "not-found"
+	case fiber.StatusMethodNotAllowed:
+		return "method-not-allowed"
+	case fiber.StatusRequestEntityTooLarge:
+		return "request-too-large"
+	case fiber.StatusTooManyRequests:
+		return "too-many-requests"
+	}
+	if status >= 500 {
+		return "internal-server-error"
+	}
+	return "request-error"
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"net"
+	"testing"
+)
+
+func TestErrorRegistryEntriesAreInTheCatalog(t *testing.T) {
+	for _, entry := range Errors.entries {
+		t.Run(entry.mapping.Code, func(t *testing.T) {
+			catalogEntry, found := ErrorCatalog[entry.mapping.Code]
+			if !found {
+				t.Fatalf("%v maps to %q, which is not in the catalog", entry.target, entry.mapping.Code)
+			}
+			if catalogEntry.Status != entry.mapping.Status {
+				t.Fatalf("%v maps to status %d, the catalog has %d", entry.target, entry.mapping.Status, catalogEntry.Status)
+			}
+			for _, language := range SupportedLanguages {
+				if catalogEntry.Detail[language] == "" {
+					t.Errorf("%q has no %s detail", entry.mapping.Code, language)
+				}
+			}
+
+			// handlers return sentinels wrapped with context
+			mapping, found := Errors.Lookup(fmt.Errorf("handler: %w", entry.target))
+			if !found {
+				t.Fatalf("wrapped %v not found", entry.target)
+			}
+			if mapping != entry.mapping && !shadowed(entry.target) {
+				t.Fatalf("wrapped %v resolves to %+v, want %+v", entry.target, mapping, entry.mapping)
+			}
+		})
+	}
+}
+
+// shadowed reports whether an earlier entry already matches target, in
+// which case Lookup never reaches target's own mapping.
+func shadowed(target error) bool {
+	for _, entry := range Errors.entries {
+		if entry.target == target {
+			return false
+		}
+		if errors.Is(target, entry.target) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBlameCaller(t *testing.T) {
+	rejected := errors.New("token mismatch")
+	cases := []struct {
+		name     string
+		err      error
+		wantCode string
+	}{
+		{name: "rejected reset token", err: rejected, wantCode: "invalid-reset-token"},
+		{name: "missing reset ticket", err: sql.ErrNoRows, wantCode: "invalid-reset-token"},
+		{name: "database error", err: &pq.Error{Code: "57P01"}, wantCode: ""},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, wantCode: ""},
+		{name: "transaction done", err: sql.ErrTxDone, wantCode: ""},
+		{name: "timeout", err: context.DeadlineExceeded, wantCode: ""},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			mapping, found := Errors.Lookup(blameCaller(testCase.err, InvalidResetToken))
+			if testCase.wantCode == "" {
+				if found && mapping.Status < 500 {
+					t.Fatalf("infrastructure failure mapped to %d %q", mapping.Status, mapping.Code)
+				}
+				return
+			}
+			if !found || mapping.Code != testCase.wantCode {
+				t.Fatalf("mapped to %+v, want %q", mapping, testCase.wantCode)
+			}
+		})
+	}
+}
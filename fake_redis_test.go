@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis speaks just enough RESP2 for the stores under test: GET, SET,
+// GETDEL, DEL and EXISTS on strings. Expiry is ignored.
+type fakeRedis struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func newFakeRedis(t *testing.T) redis.UniversalClient {
+	t.Helper()
+	listener, errListen := net.Listen("tcp", "127.0.0.1:0")
+	if errListen != nil {
+		t.Fatal(errListen)
+	}
+	server := &fakeRedis{values: map[string]string{}}
+	go func() {
+		for {
+			conn, errAccept := listener.Accept()
+			if errAccept != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+
+	client := redis.NewClient(&redis.Options{Addr: listener.Addr().String(), Protocol: 2})
+	t.Cleanup(func() {
+		client.Close()
+		listener.Close()
+	})
+	return client
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, errRead := readRESPCommand(reader)
+		if errRead != nil {
+			return
+		}
+		if _, errWrite := io.WriteString(conn, r.execute(args)); errWrite != nil {
+			return
+		}
+	}
+}
+
+func readRESPCommand(reader *bufio.Reader) ([]string, error) {
+	header, errHeader := reader.ReadString('\n')
+	if errHeader != nil {
+		return nil, errHeader
+	}
+	if !strings.HasPrefix(header, "*") {
+		return nil, fmt.Errorf("unexpected %q", header)
+	}
+	count, errCount := strconv.Atoi(strings.TrimSpace(header[1:]))
+	if errCount != nil {
+		return nil, errCount
+	}
+
+	args := make([]string, count)
+	for i := range args {
+		lengthLine, errLength := reader.ReadString('\n')
+		if errLength != nil {
+			return nil, errLength
+		}
+		length, errParse := strconv.Atoi(strings.TrimSpace(lengthLine[1:]))
+		if errParse != nil {
+			return nil, errParse
+		}
+		value := make([]byte, length+2)
+		if _, errValue := io.ReadFull(reader, value); errValue != nil {
+			return nil, errValue
+		}
+		args[i] = string(value[:length])
+	}
+	return args, nil
+}
+
+func (r *fakeRedis) execute(args []string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	bulk := func(value string, found bool) string {
+		if !found {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "CLIENT", "SELECT":
+		return "+OK\r\n"
+	case "SET":
+		r.values[args[1]] = args[2]
+		return "+OK\r\n"
+	case "GET":
+		value, found := r.values[args[1]]
+		return bulk(value, found)
+	case "GETDEL":
+		value, found := r.values[args[1]]
+		delete(r.values, args[1])
+		return bulk(value, found)
+	case "EXISTS":
+		found := 0
+		for _, key := range args[1:] {
+			if _, ok := r.values[key]; ok {
+				found++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", found)
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if _, found := r.values[key]; found {
+				delete(r.values, key)
+				deleted++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
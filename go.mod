@@ -2,23 +2,28 @@ module commonuser-example
 
 go 1.24
 
+require (
+	github.com/21strive/item v0.2.0
+	github.com/BurntSushi/toml v1.4.0
+	github.com/gofiber/fiber/v2 v2.52.9
+	github.com/golang-jwt/jwt/v5 v5.3.0
+	github.com/lib/pq v1.10.9
+	github.com/matthewhartstonge/argon2 v1.3.3
+	github.com/redis/go-redis/v9 v9.7.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
 require (
 	github.com/21strive/commonuser v0.4.0-rc.6 // indirect
-	github.com/21strive/item v0.2.0 // indirect
 	github.com/21strive/redifu v0.13.2 // indirect
 	github.com/andybalholm/brotli v1.1.0 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/gofiber/fiber/v2 v2.52.9 // indirect
-	github.com/golang-jwt/jwt/v5 v5.3.0 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/klauspost/compress v1.17.9 // indirect
-	github.com/lib/pq v1.10.9 // indirect
-	github.com/matthewhartstonge/argon2 v1.3.3 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mattn/go-runewidth v0.0.16 // indirect
-	github.com/redis/go-redis/v9 v9.7.0 // indirect
 	github.com/rivo/uniseg v0.2.0 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasthttp v1.51.0 // indirect
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"strconv"
+)
+
+const GoogleJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+var (
+	GoogleIssuers    = []string{"accounts.google.com", "https://accounts.google.com"}
+	InvalidIDToken   = errors.New("invalid ID token")
+	EmailNotVerified = errors.New("email not verified by identity provider")
+)
+
+// flexibleBool accepts both true and "true": Google has sent email_verified
+// as either over time.
+type flexibleBool bool
+
+func (b *flexibleBool) UnmarshalJSON(data []byte) error {
+	parsed, errParse := strconv.ParseBool(string(data))
+	if errParse != nil {
+		unquoted, errUnquote := strconv.Unquote(string(data))
+		if errUnquote != nil {
+			return errParse
+		}
+		if parsed, errParse = strconv.ParseBool(unquoted); errParse != nil {
+			return errParse
+		}
+	}
+	*b = flexibleBool(parsed)
+	return nil
+}
+
+type GoogleClaims struct {
+	Email         string       `json:"email"`
+	EmailVerified flexibleBool `json:"email_verified"`
+	Name          string       `json:"name"`
+	Picture       string       `json:"picture"`
+	jwt.RegisteredClaims
+}
+
+// GoogleVerifier checks a Google ID token the way Google documents it:
+// signature against Google's JWKS, audience is one of our client IDs, issuer
+// is Google, the token is not expired and the email is verified.
+type GoogleVerifier struct {
+	keys      KeySource
+	audiences []string
+}
+
+func NewGoogleVerifier(keys KeySource, clientIDs []string) *GoogleVerifier {
+	return &GoogleVerifier{
+		keys:      keys,
+		audiences: clientIDs,
+	}
+}
+
+func (v *GoogleVerifier) Verify(ctx context.Context, idToken string) (*GoogleClaims, error) {
+	claims := &GoogleClaims{}
+	_, errParse := jwt.ParseWithClaims(idToken, claims,
+		func(token *jwt.Token) (any, error) {
+			kid, _ := token.Header["kid"].(string)
+			return v.keys.Key(ctx, kid)
+		},
+		jwt.WithValidMethods([]string{"RS256"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if errParse != nil {
+		return nil, errors.Join(InvalidIDToken, errParse)
+	}
+
+	if !containsAny(GoogleIssuers, claims.Issuer) {
+		return nil, errors.Join(InvalidIDToken, jwt.ErrTokenInvalidIssuer)
+	}
+	if !containsAny(v.audiences, claims.Audience...) {
+		return nil, errors.Join(InvalidIDToken, jwt.ErrTokenInvalidAudience)
+	}
+	if claims.Subject == "" {
+		return nil, errors.Join(InvalidIDToken, jwt.ErrTokenInvalidSubject)
+	}
+	if !claims.EmailVerified {
+		return nil, EmailNotVerified
+	}
+
+	return claims, nil
+}
+
+func containsAny(allowed []string, values ...string) bool {
+	for _, value := range values {
+		for _, candidate := range allowed {
+			if value == candidate {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"testing"
+	"time"
+)
+
+const testGoogleClientID = "web.apps.googleusercontent.com"
+
+func newTestRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, errGenerate := rsa.GenerateKey(rand.Reader, 2048)
+	if errGenerate != nil {
+		t.Fatal(errGenerate)
+	}
+	return key
+}
+
+func signTestToken(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, errSign := token.SignedString(key)
+	if errSign != nil {
+		t.Fatal(errSign)
+	}
+	return signed
+}
+
+func validGoogleClaims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":            "https://accounts.google.com",
+		"aud":            testGoogleClientID,
+		"sub":            "110169484474386276334",
+		"email":          "ada@example.com",
+		"email_verified": true,
+		"name":           "Ada Lovelace",
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+}
+
+func TestGoogleVerifier(t *testing.T) {
+	key := newTestRSAKey(t)
+	otherKey := newTestRSAKey(t)
+	verifier := NewGoogleVerifier(StaticKeySource{"key-1": crypto.PublicKey(&key.PublicKey)}, []string{testGoogleClientID})
+
+	cases := []struct {
+		name    string
+		kid     string
+		signer  *rsa.PrivateKey
+		change  func(claims jwt.MapClaims)
+		wantErr error
+	}{
+		{name: "valid", change: func(jwt.MapClaims) {}},
+		{name: "email_verified as string", change: func(claims jwt.MapClaims) { claims["email_verified"] = "true" }},
+		{name: "bad audience", change: func(claims jwt.MapClaims) { claims["aud"] = "someone-else.apps.googleusercontent.com" }, wantErr: InvalidIDToken},
+		{name: "bad issuer", change: func(claims jwt.MapClaims) { claims["iss"] = "https://accounts.example.com" }, wantErr: InvalidIDToken},
+		{name: "expired", change: func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-time.Minute).Unix() }, wantErr: InvalidIDToken},
+		{name: "no expiry", change: func(claims jwt.MapClaims) { delete(claims, "exp") }, wantErr: InvalidIDToken},
+		{name: "missing subject", change: func(claims jwt.MapClaims) { delete(claims, "sub") }, wantErr: InvalidIDToken},
+		{name: "unknown kid", kid: "key-2", change: func(jwt.MapClaims) {}, wantErr: InvalidIDToken},
+		{name: "wrong signature", signer: otherKey, change: func(jwt.MapClaims) {}, wantErr: InvalidIDToken},
+		{name: "email not verified", change: func(claims jwt.MapClaims) { claims["email_verified"] = false }, wantErr: EmailNotVerified},
+		{name: "email_verified string false", change: func(claims jwt.MapClaims) { claims["email_verified"] = "false" }, wantErr: EmailNotVerified},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			claims := validGoogleClaims()
+			testCase.change(claims)
+			kid := testCase.kid
+			if kid == "" {
+				kid = "key-1"
+			}
+			signer := testCase.signer
+			if signer == nil {
+				signer = key
+			}
+
+			verified, errVerify := verifier.Verify(context.Background(), signTestToken(t, signer, kid, claims))
+			if testCase.wantErr == nil {
+				if errVerify != nil {
+					t.Fatalf("unexpected error: %v", errVerify)
+				}
+				if verified.Email != "ada@example.com" || verified.Subject != "110169484474386276334" {
+					t.Errorf("unexpected claims: %+v", verified)
+				}
+				return
+			}
+			if !errors.Is(errVerify, testCase.wantErr) {
+				t.Fatalf("got %v, want %v", errVerify, testCase.wantErr)
+			}
+		})
+	}
+}
+
+func TestGoogleVerifierUnknownKidIsKeyNotFound(t *testing.T) {
+	key := newTestRSAKey(t)
+	verifier := NewGoogleVerifier(StaticKeySource{}, []string{testGoogleClientID})
+
+	_, errVerify := verifier.Verify(context.Background(), signTestToken(t, key, "rotated", validGoogleClaims()))
+	if !errors.Is(errVerify, KeyNotFound) {
+		t.Fatalf("got %v, want KeyNotFound", errVerify)
+	}
+}
@@ -1,14 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/21strive/commonuser/account"
-	"github.com/21strive/commonuser/jwt_impl"
 	"github.com/21strive/item"
 	"github.com/gofiber/fiber/v2"
 	"github.com/redis/go-redis/v9"
@@ -20,10 +18,20 @@ import (
 )
 
 var Logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+var LogComponent = DefaultLogComponent
 
+// ServiceError is an RFC 7807 problem document extended with the stable
+// error code, the id used to find the matching log line and, for invalid
+// payloads, the failed rule of each field.
 type ServiceError struct {
-	Code string `json:"code"`
-	ID   string `json:"id"`
+	Type     string           `json:"type"`
+	Title    string           `json:"title"`
+	Status   int              `json:"status"`
+	Detail   string           `json:"detail,omitempty"`
+	Instance string           `json:"instance,omitempty"`
+	Code     string           `json:"code"`
+	ID       string           `json:"id"`
+	Errors   ValidationErrors `json:"errors,omitempty"`
 }
 
 func CreatePostgresConnection(host string, port string, user string, password string, dbname string, sslmode string) *sql.DB {
@@ -86,9 +94,20 @@ func ConnectRedis(host string, username string, password string, isClustered boo
 func ErrorResponse(c *fiber.Ctx, status int, error error, appCode string, source ...string) error {
 	errorId := item.RandId()
 
+	entry := LookupCatalog(appCode, status)
 	response := ServiceError{
-		Code: appCode,
-		ID:   errorId,
+		Type:     entry.Type(),
+		Title:    entry.Title,
+		Status:   status,
+		Detail:   entry.LocalizedDetail(c),
+		Instance: c.OriginalURL(),
+		Code:     appCode,
+		ID:       errorId,
+	}
+
+	var validationErrors ValidationErrors
+	if errors.As(error, &validationErrors) {
+		response.Errors = validationErrors
 	}
 
 	type LogEntry struct {
@@ -97,9 +116,7 @@ func ErrorResponse(c *fiber.Ctx, status int, error error, appCode string, source
 
 	var inputBody json.RawMessage
 	if c.Request().Body() != nil && len(c.Request().Body()) > 0 {
-		var compactJSON bytes.Buffer
-		json.Compact(&compactJSON, c.Request().Body())
-		inputBody = compactJSON.Bytes()
+		inputBody = LogRedactor.Redact(c.Request().Body())
 	}
 
 	logEntry := LogEntry{inputBody}
@@ -118,39 +135,69 @@ func ErrorResponse(c *fiber.Ctx, status int, error error, appCode string, source
 		returnedError = errors.New("error").Error()
 	}
 	Logger.Error("endpoint-error",
-		"component", "paystore", "source", sourceStr, "appCode", appCode,
+		"component", LogComponent, "source", sourceStr, "appCode", appCode,
 		"error", returnedError, "ID", errorId, "input", logEntry)
 
-	c.Set("Content-Type", "application/json")
-	return c.Status(status).JSON(response)
+	return c.Status(status).JSON(response, "application/problem+json")
 }
 
-func MiddlewareTokenAuth(c *fiber.Ctx) error {
-	authHeader := c.Get("Authorization")
-	if authHeader == "" {
-		return ErrorResponse(c, fiber.StatusUnauthorized, errors.New("authorization header required"), "E1006", "MiddlewareTokenAuth.MissingHeader")
-	}
+// MiddlewareTokenAuth verifies the bearer token. With a non-nil checker it
+// also rejects tokens whose session has been revoked; pass nil for routes
+// that may trade that guarantee for one less cache round trip.
+func MiddlewareTokenAuth(keyring *Keyring, checker *SessionChecker) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		authHeader := c.Get("Authorization")
+		if authHeader == "" {
+			return ErrorResponse(c, fiber.StatusUnauthorized, errors.New("authorization header required"), "missing-authorization", "MiddlewareTokenAuth.MissingHeader")
+		}
 
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-	if tokenString == authHeader {
-		return ErrorResponse(c, fiber.StatusUnauthorized, errors.New("bearer token required"), "E1006", "MiddlewareTokenAuth.InvalidFormat")
+		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+		if tokenString == authHeader {
+			return ErrorResponse(c, fiber.StatusUnauthorized, errors.New("bearer token required"), "invalid-authorization", "MiddlewareTokenAuth.InvalidFormat")
+		}
+
+		userClaims, err := keyring.ParseAccessToken(tokenString)
+		if err != nil {
+			return ErrorResponse(c, fiber.StatusUnauthorized, err, "invalid-token", "MiddlewareTokenAuth.ParseToken")
+		}
+
+		account := account.New()
+		account.UUID = userClaims.UUID
+		account.RandId = userClaims.RandId
+		account.Base.Name = userClaims.Name
+		account.Base.Username = userClaims.Username
+		account.Base.Email = userClaims.Email
+		account.Base.Avatar = userClaims.Avatar
+
+		if checker != nil {
+			errCheck := checker.Check(account, userClaims.SessionID)
+			if errors.Is(errCheck, SessionInvalid) {
+				return ErrorResponse(c, fiber.StatusUnauthorized, errCheck, "session-revoked", "MiddlewareTokenAuth.CheckSession")
+			}
+			if errCheck != nil {
+				return ErrorResponse(c, fiber.StatusInternalServerError, errCheck, "internal-server-error", "MiddlewareTokenAuth.CheckSession")
+			}
+		}
+
+		c.Locals("account", account)
+		c.Locals("sessionid", userClaims.SessionID)
+		return c.Next()
 	}
+}
 
-	jwtHandler := jwt_impl.NewJWTHandler(SystemJWTSecret, SystemJWTIssuer, int(SystemJWTLifespan))
-	userClaims, err := jwtHandler.ParseAccessToken(tokenString)
-	if err != nil {
-		return ErrorResponse(c, fiber.StatusUnauthorized, err, "E1006", "MiddlewareTokenAuth.ParseToken")
+// MiddlewareRequireAdmin must run after MiddlewareTokenAuth. It only lets
+// through accounts listed in the admin configuration.
+func MiddlewareRequireAdmin(adminConfig AdminConfig) fiber.Handler {
+	admins := make(map[string]struct{}, len(adminConfig.AccountUUIDs))
+	for _, accountUUID := range adminConfig.AccountUUIDs {
+		admins[accountUUID] = struct{}{}
 	}
 
-	account := account.New()
-	account.UUID = userClaims.UUID
-	account.RandId = userClaims.RandId
-	account.Base.Name = userClaims.Name
-	account.Base.Username = userClaims.Username
-	account.Base.Email = userClaims.Email
-	account.Base.Avatar = userClaims.Avatar
-
-	c.Locals("account", account)
-	c.Locals("sessionid", userClaims.SessionID)
-	return c.Next()
+	return func(c *fiber.Ctx) error {
+		account := c.Locals("account").(*account.Account)
+		if _, isAdmin := admins[account.GetUUID()]; !isAdmin {
+			return ErrorResponse(c, fiber.StatusForbidden, errors.New("admin privileges required"), "forbidden", "MiddlewareRequireAdmin")
+		}
+		return c.Next()
+	}
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"database/sql"
 	"errors"
 	"github.com/21strive/commonuser"
@@ -8,13 +10,105 @@ import (
 	"github.com/21strive/commonuser/provider"
 	"github.com/21strive/commonuser/session"
 	"github.com/gofiber/fiber/v2"
+	"strings"
 	"time"
 )
 
 type HTTPHandler struct {
-	writeDB           *sql.DB
-	commonuser        *commonuser.Service
-	commonuserFetcher *commonuser.Fetchers
+	writeDB            *sql.DB
+	commonuser         *commonuser.Service
+	commonuserFetcher  *commonuser.Fetchers
+	keyring            *Keyring
+	refreshTokens      *RefreshTokenStore
+	sessionConfig      SessionConfig
+	sessionCache       *SessionCache
+	google             *GoogleVerifier
+	oidcProviders      OIDCProviders
+	oidcStates         *OIDCStateStore
+	pendingLinks       *PendingLinkStore
+	providerLinkConfig ProviderLinkConfig
+	recentAuth         *RecentAuthStore
+	passwordPolicy     *PasswordPolicy
+	passwordHistory    *PasswordHistory
+	mailer             Mailer
+	emailTemplates     *EmailTemplates
+	accountLocales     *AccountLocales
+	verifiedEmails     *VerifiedEmails
+}
+
+func setRefreshTokenCookie(c *fiber.Ctx, refreshToken string) {
+	c.Cookie(&fiber.Cookie{
+		Name:     "refreshToken",
+		Value:    refreshToken,
+		HTTPOnly: true,
+		Secure:   true,
+		SameSite: "Strict",
+	})
+}
+
+// setOIDCStateCookie binds an OIDC flow to the browser that starts it. It
+// holds a hash of the state, so /callback can refuse a state that was
+// started elsewhere, which is how login CSRF hands a victim the attacker's
+// session. A form_post callback is a cross-site POST, which only carries a
+// SameSite=None cookie.
+func setOIDCStateCookie(c *fiber.Ctx, oidcProvider *OIDCProvider, state string) {
+	sameSite := "Lax"
+	if oidcProvider.FormPost() {
+		sameSite = "None"
+	}
+	c.Cookie(&fiber.Cookie{
+		Name:     "oidcState",
+		Value:    hashRefreshToken(state),
+		Path:     "/auth",
+		MaxAge:   int(OIDCStateLifespan.Seconds()),
+		HTTPOnly: true,
+		Secure:   true,
+		SameSite: sameSite,
+	})
+}
+
+// oidcStateFromThisBrowser checks the state of a callback against the
+// cookie set by setOIDCStateCookie, and clears the cookie.
+func oidcStateFromThisBrowser(c *fiber.Ctx, state string) bool {
+	cookie := c.Cookies("oidcState")
+	c.Cookie(&fiber.Cookie{
+		Name:     "oidcState",
+		Path:     "/auth",
+		Expires:  time.Unix(0, 0),
+		HTTPOnly: true,
+		Secure:   true,
+	})
+	if cookie == "" || state == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie), []byte(hashRefreshToken(state))) == 1
+}
+
+// issueTokens stamps the access token with the active signing key, indexes
+// the refresh token so /refresh can resolve it later and sets it as cookie.
+// An empty family starts a new refresh-token family.
+func (h *HTTPHandler) issueTokens(c *fiber.Ctx, accessToken string, refreshToken string, family string) (string, error) {
+	stampedToken, errStamp := h.keyring.Stamp(accessToken)
+	if errStamp != nil {
+		return "", errStamp
+	}
+
+	claims, errParse := h.keyring.ParseAccessToken(stampedToken)
+	if errParse != nil {
+		return "", errParse
+	}
+
+	_, errBind := h.refreshTokens.Bind(c.Context(), refreshToken, RefreshBinding{
+		AccountUUID: claims.UUID,
+		SessionID:   claims.SessionID,
+		Family:      family,
+	})
+	if errBind != nil {
+		return "", errBind
+	}
+
+	setRefreshTokenCookie(c, refreshToken)
+	return stampedToken, nil
 }
 
 func (h *HTTPHandler) Registration(c *fiber.Ctx) error {
@@ -22,6 +116,12 @@ func (h *HTTPHandler) Registration(c *fiber.Ctx) error {
 	if err := c.BodyParser(&requestBody); err != nil {
 		return ErrorResponse(c, fiber.StatusBadRequest, err, "invalid-request-body")
 	}
+	if err := RequestValidator.Validate(requestBody); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "validation-failed")
+	}
+	if err := h.passwordPolicy.Check("password", requestBody.Password, requestBody.Name, requestBody.Username, requestBody.Email); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "password-policy")
+	}
 
 	tx, errInitTx := h.writeDB.Begin()
 	if errInitTx != nil {
@@ -60,6 +160,24 @@ func (h *HTTPHandler) Registration(c *fiber.Ctx) error {
 		return ErrorResponse(c, fiber.StatusInternalServerError, regError, "internal-server-error")
 	}
 
+	errHistory := h.passwordHistory.Record(tx, newAccount.GetUUID(), requestBody.Password)
+	if errHistory != nil {
+		return ErrorResponse(c, fiber.StatusInternalServerError, errHistory, "internal-server-error")
+	}
+
+	// with no Accept-Language header Fiber answers the first offer, which
+	// would then be stored as if the client had asked for it
+	locale := requestBody.Locale
+	if locale == "" && c.Get(fiber.HeaderAcceptLanguage) != "" {
+		locale = c.AcceptsLanguages(SupportedLanguages...)
+	}
+	if locale != "" {
+		errLocale := h.accountLocales.Set(tx, newAccount.GetUUID(), locale)
+		if errLocale != nil {
+			return ErrorResponse(c, fiber.StatusInternalServerError, errLocale, "internal-server-error")
+		}
+	}
+
 	errorCreateSession := h.commonuser.Session().Create(tx, newSession)
 	if errorCreateSession != nil {
 		return ErrorResponse(c, fiber.StatusInternalServerError, errorCreateSession, "internal-server-error")
@@ -70,21 +188,20 @@ func (h *HTTPHandler) Registration(c *fiber.Ctx) error {
 		return ErrorResponse(c, fiber.StatusInternalServerError, errCommit, "internal-server-error")
 	}
 
-	response := map[string]string{
-		"accessToken": accessToken,
+	accessToken, errIssue := h.issueTokens(c, accessToken, newSession.RefreshToken, "")
+	if errIssue != nil {
+		return ErrorResponse(c, fiber.StatusInternalServerError, errIssue, "internal-server-error")
 	}
+
 	if verification != nil {
-		response["verificationCode"] = *verification
+		h.sendEmail(c, EmailVerification, newAccount.Email, EmailData{
+			Name:        newAccount.Name,
+			AccountUUID: newAccount.GetUUID(),
+			Code:        *verification,
+		})
 	}
 
-	c.Cookie(&fiber.Cookie{
-		Name:     "refreshToken",
-		Value:    newSession.RefreshToken,
-		HTTPOnly: true,
-		Secure:   true,
-		SameSite: "Strict",
-	})
-	return c.JSON(response)
+	return c.JSON(map[string]string{"accessToken": accessToken})
 }
 
 func (h *HTTPHandler) VerifyRegistration(c *fiber.Ctx) error {
@@ -95,6 +212,9 @@ func (h *HTTPHandler) VerifyRegistration(c *fiber.Ctx) error {
 	if err := c.BodyParser(&requestBody); err != nil {
 		return ErrorResponse(c, fiber.StatusBadRequest, err, "invalid-request-body")
 	}
+	if err := RequestValidator.Validate(requestBody); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "validation-failed")
+	}
 
 	tx, errInitTx := h.writeDB.Begin()
 	if errInitTx != nil {
@@ -107,11 +227,21 @@ func (h *HTTPHandler) VerifyRegistration(c *fiber.Ctx) error {
 		return ErrorResponse(c, fiber.StatusUnauthorized, errVerify, "invalid-verification-code")
 	}
 
+	errMark := h.verifiedEmails.Mark(tx, account.GetUUID(), account.Email)
+	if errMark != nil {
+		return ErrorResponse(c, fiber.StatusInternalServerError, errMark, "internal-server-error")
+	}
+
 	errCommit := tx.Commit()
 	if errCommit != nil {
 		return ErrorResponse(c, fiber.StatusInternalServerError, errCommit, "internal-server-error")
 	}
 
+	newAccessToken, errStamp := h.keyring.Stamp(newAccessToken)
+	if errStamp != nil {
+		return ErrorResponse(c, fiber.StatusInternalServerError, errStamp, "internal-server-error")
+	}
+
 	return c.JSON(map[string]string{"accessToken": newAccessToken})
 }
 
@@ -120,6 +250,9 @@ func (h *HTTPHandler) AuthWithEmail(c *fiber.Ctx) error {
 	if err := c.BodyParser(&requestBody); err != nil {
 		return ErrorResponse(c, fiber.StatusBadRequest, err, "invalid-request-body")
 	}
+	if err := RequestValidator.Validate(requestBody); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "validation-failed")
+	}
 
 	deviceInfo := commonuser.DeviceInfo{
 		DeviceId:   requestBody.DeviceId,
@@ -134,17 +267,16 @@ func (h *HTTPHandler) AuthWithEmail(c *fiber.Ctx) error {
 		deviceInfo,
 	)
 	if errToken != nil {
-		return errToken
+		return h.rejectLogin(c, errToken, func() (*account.Account, error) {
+			return h.commonuser.Find().ByEmail(requestBody.Email)
+		}, requestBody.Password)
 	}
 
-	c.Cookie(&fiber.Cookie{
-		Name:     "refreshToken",
-		Value:    refreshToken,
-		HTTPOnly: true,
-		Secure:   true,
-		SameSite: "Strict",
-	})
-
+	accessToken, errIssue := h.issueTokens(c, accessToken, refreshToken, "")
+	if errIssue != nil {
+		return ErrorResponse(c, fiber.StatusInternalServerError, errIssue, "internal-server-error")
+	}
+	h.alertNewLogin(c, accessToken, deviceInfo)
 	return c.JSON(map[string]string{"accessToken": accessToken})
 }
 
@@ -153,6 +285,9 @@ func (h *HTTPHandler) AuthWithUsername(c *fiber.Ctx) error {
 	if err := c.BodyParser(&requestBody); err != nil {
 		return ErrorResponse(c, fiber.StatusBadRequest, err, "invalid-request-body")
 	}
+	if err := RequestValidator.Validate(requestBody); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "validation-failed")
+	}
 
 	deviceInfo := commonuser.DeviceInfo{
 		DeviceId:   requestBody.DeviceId,
@@ -167,24 +302,101 @@ func (h *HTTPHandler) AuthWithUsername(c *fiber.Ctx) error {
 		deviceInfo,
 	)
 	if errToken != nil {
-		return errToken
+		return h.rejectLogin(c, errToken, func() (*account.Account, error) {
+			return h.commonuser.Find().ByUsername(requestBody.Username)
+		}, requestBody.Password)
 	}
 
-	c.Cookie(&fiber.Cookie{
-		Name:     "refreshToken",
-		Value:    refreshToken,
-		HTTPOnly: true,
-		Secure:   true,
-		SameSite: "Strict",
-	})
+	accessToken, errIssue := h.issueTokens(c, accessToken, refreshToken, "")
+	if errIssue != nil {
+		return ErrorResponse(c, fiber.StatusInternalServerError, errIssue, "internal-server-error")
+	}
+	h.alertNewLogin(c, accessToken, deviceInfo)
 	return c.JSON(map[string]string{"accessToken": accessToken})
 }
 
+// alertNewLogin emails the owner when an account is signed in to from a
+// device none of its other sessions uses. Failures are only logged: the
+// login itself already succeeded.
+func (h *HTTPHandler) alertNewLogin(c *fiber.Ctx, accessToken string, deviceInfo commonuser.DeviceInfo) {
+	logFailure := func(err error) {
+		Logger.Error("mail-error", "component", LogComponent, "kind", EmailNewLogin, "error", err.Error())
+	}
+
+	claims, errParse := h.keyring.ParseAccessToken(accessToken)
+	if errParse != nil {
+		logFailure(errParse)
+		return
+	}
+	userAccount, errFind := h.commonuser.Find().ByUUID(claims.UUID)
+	if errFind != nil {
+		logFailure(errFind)
+		return
+	}
+	if userAccount.Email == "" {
+		return
+	}
+
+	sessions, errFetch := h.fetchAccountSessions(userAccount)
+	if errFetch != nil {
+		logFailure(errFetch)
+		return
+	}
+	for _, accountSession := range sessions {
+		if accountSession.GetRandId() != claims.SessionID && deviceInfo.DeviceId != "" && accountSession.DeviceId == deviceInfo.DeviceId {
+			return
+		}
+	}
+
+	device := strings.TrimSpace(deviceInfo.DeviceType + " " + deviceInfo.UserAgent)
+	if device == "" {
+		device = "unknown"
+	}
+	h.sendEmail(c, EmailNewLogin, userAccount.Email, EmailData{
+		Name:        userAccount.Name,
+		AccountUUID: userAccount.GetUUID(),
+		Device:      device,
+		IPAddress:   c.IP(),
+		Time:        time.Now(),
+	})
+}
+
+// rejectLogin answers an unknown account and a wrong password with the same
+// 401, so the response cannot tell them apart, and any other failure, such as
+// the database being down, with a 500. The library has no error of its own
+// for a wrong password, so find looks the account up again to tell which.
+func (h *HTTPHandler) rejectLogin(c *fiber.Ctx, errLogin error, find func() (*account.Account, error), password string) error {
+	userAccount, errFind := find()
+	if errFind != nil && !errors.Is(errFind, account.NotFound) {
+		return ErrorResponse(c, fiber.StatusInternalServerError, errFind, "internal-server-error")
+	}
+
+	// every 401 costs two argon2 checks. The library already did one for an
+	// account with a password and this check is the second; a missing account
+	// or one without a password got none from the library, so both are burnt
+	if userAccount == nil || userAccount.Password == "" {
+		burnPasswordCheck(password)
+		burnPasswordCheck(password)
+		return ErrorResponse(c, fiber.StatusUnauthorized, errLogin, "invalid-credentials")
+	}
+	matches, errVerify := verifyPassword([]byte(password), []byte(userAccount.Password))
+	if errVerify != nil {
+		burnPasswordCheck(password)
+	}
+	if !matches {
+		return ErrorResponse(c, fiber.StatusUnauthorized, errLogin, "invalid-credentials")
+	}
+	return ErrorResponse(c, fiber.StatusInternalServerError, errLogin, "internal-server-error")
+}
+
 func (h *HTTPHandler) AuthWithGoogle(c *fiber.Ctx) error {
 	var requestBody AuthWithGoogle
 	if err := c.BodyParser(&requestBody); err != nil {
 		return ErrorResponse(c, fiber.StatusBadRequest, err, "invalid-request-body")
 	}
+	if err := RequestValidator.Validate(requestBody); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "validation-failed")
+	}
 
 	deviceInfo := commonuser.DeviceInfo{
 		DeviceId:   requestBody.DeviceId,
@@ -192,56 +404,581 @@ func (h *HTTPHandler) AuthWithGoogle(c *fiber.Ctx) error {
 		UserAgent:  requestBody.UserAgent,
 	}
 
-	var accessToken string
-	var refreshToken string
-	accessToken, refreshToken, errAuth := h.commonuser.Authenticate().ByProvider(h.writeDB, "google", requestBody.Sub, deviceInfo)
+	claims, errVerify := h.google.Verify(c.Context(), requestBody.IDToken)
+	if errVerify != nil {
+		if errors.Is(errVerify, EmailNotVerified) {
+			return ErrorResponse(c, fiber.StatusForbidden, errVerify, "email-not-verified")
+		}
+		return ErrorResponse(c, fiber.StatusUnauthorized, errVerify, "invalid-id-token")
+	}
+
+	login, errAuth := h.authenticateWithProvider(c, &ProviderIdentity{
+		Issuer:        "google",
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+		Name:          claims.Name,
+	}, deviceInfo)
 	if errAuth != nil {
-		if errors.Is(errAuth, provider.ProviderNotFound) {
-			newAccount := account.New()
-			newAccount.SetName(requestBody.Name)
-			newAccount.SetEmail(requestBody.Email)
-
-			newProvider := provider.New()
-			newProvider.SetIssuer("google")
-			newProvider.SetEmail(requestBody.Email)
-			newProvider.SetName(requestBody.Name)
-			newProvider.SetSub(requestBody.Sub)
-			newProvider.SetAccount(newAccount)
-
-			errRegister := h.commonuser.RegisterWithProvider(h.writeDB, newAccount, newProvider)
-			if errRegister != nil {
-				return ErrorResponse(c, fiber.StatusInternalServerError, errRegister, "internal-server-error")
+		return h.providerLoginError(c, errAuth)
+	}
+
+	return h.respondProviderLogin(c, login)
+}
+
+// providerLoginError answers a failed provider login or link.
+func (h *HTTPHandler) providerLoginError(c *fiber.Ctx, errLogin error) error {
+	if errors.Is(errLogin, ProviderLinkedToOther) {
+		return ErrorResponse(c, fiber.StatusConflict, errLogin, "provider-already-linked")
+	}
+	return ErrorResponse(c, fiber.StatusInternalServerError, errLogin, "internal-server-error")
+}
+
+// providerLogin is the outcome of a provider login: either tokens, or a
+// link token when the identity must first be confirmed by the owner of the
+// account holding the same email.
+type providerLogin struct {
+	accessToken  string
+	refreshToken string
+	linkToken    string
+	deviceInfo   commonuser.DeviceInfo
+	registered   bool
+}
+
+// authenticateWithProvider signs in the account linked to the identity. On
+// the first login the identity is linked to the account with the same email,
+// following the configured link policy, or a new account is registered. An
+// email the provider has not verified is kept on the provider record only and
+// is never matched against existing accounts, so it can neither take over an
+// account nor reveal through a link offer that one exists.
+func (h *HTTPHandler) authenticateWithProvider(c *fiber.Ctx, identity *ProviderIdentity, deviceInfo commonuser.DeviceInfo) (*providerLogin, error) {
+	accessToken, refreshToken, errAuth := h.commonuser.Authenticate().ByProvider(h.writeDB, identity.Issuer, identity.Subject, deviceInfo)
+	if errAuth == nil {
+		return &providerLogin{accessToken: accessToken, refreshToken: refreshToken, deviceInfo: deviceInfo}, nil
+	}
+	if !errors.Is(errAuth, provider.ProviderNotFound) {
+		return nil, errAuth
+	}
+
+	if identity.Email != "" && identity.EmailVerified {
+		existingAccount, errFind := h.commonuser.Find().ByEmail(identity.Email)
+		if errFind == nil {
+			autoLink := h.providerLinkConfig.Policy == ProviderLinkAutoVerifiedEmail
+			if autoLink {
+				// the local address must be proven too, or whoever registered
+				// it first would get the provider login
+				verified, errVerified := h.verifiedEmails.IsVerified(h.writeDB, existingAccount.GetUUID(), existingAccount.Email)
+				if errVerified != nil {
+					return nil, errVerified
+				}
+				autoLink = verified
+			}
+			if autoLink {
+				errLink := h.linkProvider(existingAccount, identity)
+				if errLink != nil {
+					return nil, errLink
+				}
+				return h.signInLinkedAccount(existingAccount, deviceInfo)
 			}
 
-			// NOTE: This section might be part of a database transaction. If that happens,
-			// the transaction must be committed before the re-authenticate section runs.
-			var errReAuth error
-			accessToken, refreshToken, errReAuth = h.commonuser.Authenticate().ByProvider(h.writeDB, "google", requestBody.Sub, deviceInfo)
-			if errReAuth != nil {
-				return ErrorResponse(c, fiber.StatusInternalServerError, errReAuth, "internal-server-error")
+			linkToken, errSave := h.pendingLinks.Save(c.Context(), PendingProviderLink{
+				AccountUUID: existingAccount.GetUUID(),
+				Identity:    *identity,
+				DeviceInfo:  deviceInfo,
+			})
+			if errSave != nil {
+				return nil, errSave
 			}
-		} else {
-			return ErrorResponse(c, fiber.StatusInternalServerError, errAuth, "internal-server-error")
+			return &providerLogin{linkToken: linkToken}, nil
+		}
+		if !errors.Is(errFind, account.NotFound) {
+			return nil, errFind
 		}
 	}
 
-	c.Cookie(&fiber.Cookie{
-		Name:     "refreshToken",
-		Value:    refreshToken,
-		HTTPOnly: true,
-		Secure:   true,
-		SameSite: "Strict",
-	})
+	return h.registerWithProvider(identity, deviceInfo)
+}
+
+// registerWithProvider creates the account, its provider record and the first
+// session in one transaction, so a failure can leave neither an account
+// without a session nor a provider without an account.
+func (h *HTTPHandler) registerWithProvider(identity *ProviderIdentity, deviceInfo commonuser.DeviceInfo) (*providerLogin, error) {
+	tx, errInitTx := h.writeDB.Begin()
+	if errInitTx != nil {
+		return nil, errInitTx
+	}
+	defer tx.Rollback()
+
+	newAccount := account.New()
+	newAccount.SetName(identity.Name)
+	if identity.EmailVerified {
+		newAccount.SetEmail(identity.Email)
+	}
+
+	errRegister := h.commonuser.RegisterWithProvider(tx, newAccount, newProviderRecord(newAccount, identity))
+	if errRegister != nil {
+		return nil, errRegister
+	}
+
+	if identity.EmailVerified {
+		errMark := h.verifiedEmails.Mark(tx, newAccount.GetUUID(), newAccount.Email)
+		if errMark != nil {
+			return nil, errMark
+		}
+	}
+
+	accessToken, refreshToken, errSession := h.createSession(tx, newAccount, deviceInfo)
+	if errSession != nil {
+		return nil, errSession
+	}
+
+	errCommit := tx.Commit()
+	if errCommit != nil {
+		return nil, errCommit
+	}
+
+	return &providerLogin{accessToken: accessToken, refreshToken: refreshToken, deviceInfo: deviceInfo, registered: true}, nil
+}
+
+// signInLinkedAccount opens a session for an account a provider was just
+// linked to. It does not go back through Authenticate().ByProvider, whose
+// cache may not know the new link yet.
+func (h *HTTPHandler) signInLinkedAccount(owner *account.Account, deviceInfo commonuser.DeviceInfo) (*providerLogin, error) {
+	tx, errInitTx := h.writeDB.Begin()
+	if errInitTx != nil {
+		return nil, errInitTx
+	}
+	defer tx.Rollback()
+
+	accessToken, refreshToken, errSession := h.createSession(tx, owner, deviceInfo)
+	if errSession != nil {
+		return nil, errSession
+	}
+
+	errCommit := tx.Commit()
+	if errCommit != nil {
+		return nil, errCommit
+	}
+
+	return &providerLogin{accessToken: accessToken, refreshToken: refreshToken, deviceInfo: deviceInfo}, nil
+}
+
+// createSession creates a session of owner for the device and returns its
+// access and refresh tokens.
+func (h *HTTPHandler) createSession(tx *sql.Tx, owner *account.Account, deviceInfo commonuser.DeviceInfo) (string, string, error) {
+	newSession := session.NewSession()
+	newSession.SetAccountUUID(owner.GetUUID())
+	newSession.SetDeviceId(deviceInfo.DeviceId)
+	newSession.SetDeviceType(deviceInfo.DeviceType)
+	newSession.SetUserAgent(deviceInfo.UserAgent)
+	newSession.SetLastActiveAt(time.Now())
+	newSession.SetLifeSpan(h.commonuser.Config().TokenLifespan)
+	newSession.GenerateRefreshToken()
+
+	accessToken, errGen := owner.GenerateAccessToken(
+		h.commonuser.Config().JWTSecret,
+		h.commonuser.Config().JWTIssuer,
+		h.commonuser.Config().JWTLifespan,
+		newSession.GetRandId(),
+	)
+	if errGen != nil {
+		return "", "", errGen
+	}
+
+	errCreateSession := h.commonuser.Session().Create(tx, newSession)
+	if errCreateSession != nil {
+		return "", "", errCreateSession
+	}
+	return accessToken, newSession.RefreshToken, nil
+}
+
+func newProviderRecord(owner *account.Account, identity *ProviderIdentity) *provider.Provider {
+	newProvider := provider.New()
+	newProvider.SetIssuer(identity.Issuer)
+	newProvider.SetEmail(identity.Email)
+	newProvider.SetName(identity.Name)
+	newProvider.SetSub(identity.Subject)
+	newProvider.SetAccount(owner)
+	return newProvider
+}
+
+// linkProvider attaches the identity to an existing account. Linking an
+// identity the account already has is a no-op.
+func (h *HTTPHandler) linkProvider(owner *account.Account, identity *ProviderIdentity) error {
+	linkedProvider, errFind := h.commonuser.Provider().Find(identity.Issuer, identity.Subject)
+	if errFind == nil {
+		if linkedProvider.AccountUUID != owner.GetUUID() {
+			return ProviderLinkedToOther
+		}
+		return nil
+	}
+	if !errors.Is(errFind, provider.ProviderNotFound) {
+		return errFind
+	}
+
+	errCreate := h.commonuser.Provider().Create(h.writeDB, newProviderRecord(owner, identity))
+	if errCreate != nil {
+		return errCreate
+	}
+
+	Logger.Info("security-event",
+		"component", LogComponent, "event", "provider-linked",
+		"accountUUID", owner.GetUUID(), "issuer", identity.Issuer)
+	return nil
+}
+
+// respondProviderLogin answers a provider login: 202 with a link token when
+// the owner still has to confirm the link, tokens otherwise.
+func (h *HTTPHandler) respondProviderLogin(c *fiber.Ctx, login *providerLogin) error {
+	if login.linkToken != "" {
+		return c.Status(fiber.StatusAccepted).JSON(map[string]string{"linkToken": login.linkToken})
+	}
+
+	accessToken, errIssue := h.issueTokens(c, login.accessToken, login.refreshToken, "")
+	if errIssue != nil {
+		return ErrorResponse(c, fiber.StatusInternalServerError, errIssue, "internal-server-error")
+	}
+
+	claims, errParse := h.keyring.ParseAccessToken(accessToken)
+	if errParse != nil {
+		return ErrorResponse(c, fiber.StatusInternalServerError, errParse, "internal-server-error")
+	}
+	errMark := h.recentAuth.Mark(c.Context(), claims.SessionID)
+	if errMark != nil {
+		return ErrorResponse(c, fiber.StatusInternalServerError, errMark, "internal-server-error")
+	}
+	if !login.registered {
+		h.alertNewLogin(c, accessToken, login.deviceInfo)
+	}
+
 	return c.JSON(map[string]string{"accessToken": accessToken})
 }
 
+// ConfirmProviderLink links a pending provider identity once the owner of the
+// matching account proves it with their password.
+func (h *HTTPHandler) ConfirmProviderLink(c *fiber.Ctx) error {
+	var requestBody ConfirmProviderLink
+	if err := c.BodyParser(&requestBody); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "invalid-request-body")
+	}
+	if err := RequestValidator.Validate(requestBody); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "validation-failed")
+	}
+
+	pendingLink, errTake := h.pendingLinks.Take(c.Context(), requestBody.LinkToken)
+	if errTake != nil {
+		if errors.Is(errTake, PendingLinkNotFound) {
+			return ErrorResponse(c, fiber.StatusBadRequest, errTake, "invalid-link-token")
+		}
+		return ErrorResponse(c, fiber.StatusInternalServerError, errTake, "internal-server-error")
+	}
+
+	owner, errFind := h.commonuser.Find().ByUUID(pendingLink.AccountUUID)
+	if errFind != nil {
+		if errors.Is(errFind, account.NotFound) {
+			return ErrorResponse(c, fiber.StatusBadRequest, errFind, "invalid-link-token")
+		}
+		return ErrorResponse(c, fiber.StatusInternalServerError, errFind, "internal-server-error")
+	}
+
+	// the password login doubles as the proof of ownership and as the login
+	accessToken, refreshToken, errPassword := h.commonuser.Authenticate().ByEmail(h.writeDB, owner.Email, requestBody.Password, pendingLink.DeviceInfo)
+	if errPassword != nil {
+		return ErrorResponse(c, fiber.StatusUnauthorized, errPassword, "invalid-link-password")
+	}
+
+	errLink := h.linkProvider(owner, &pendingLink.Identity)
+	if errLink != nil {
+		return h.providerLoginError(c, errLink)
+	}
+
+	return h.respondProviderLogin(c, &providerLogin{accessToken: accessToken, refreshToken: refreshToken, deviceInfo: pendingLink.DeviceInfo})
+}
+
+// OIDCStart redirects the browser to the provider's consent page. The PKCE
+// verifier and nonce stay server-side, keyed by the state parameter.
+func (h *HTTPHandler) OIDCStart(c *fiber.Ctx) error {
+	oidcProvider, errProvider := h.oidcProviders.Get(c.Params("provider"))
+	if errProvider != nil {
+		return ErrorResponse(c, fiber.StatusNotFound, errProvider, "oidc-provider-not-found")
+	}
+
+	state, errState := NewOIDCState(c.Params("provider"), commonuser.DeviceInfo{
+		DeviceId:   c.Query("deviceId"),
+		DeviceType: c.Query("deviceType"),
+		UserAgent:  c.Get("User-Agent"),
+	})
+	if errState != nil {
+		return ErrorResponse(c, fiber.StatusInternalServerError, errState, "internal-server-error")
+	}
+
+	authorizationURL, errStart := h.startOIDCFlow(c, oidcProvider, state)
+	if errStart != nil {
+		if errors.Is(errStart, OIDCExchangeFailed) {
+			return ErrorResponse(c, fiber.StatusBadGateway, errStart, "oidc-exchange-failed")
+		}
+		return ErrorResponse(c, fiber.StatusInternalServerError, errStart, "internal-server-error")
+	}
+	return c.Redirect(authorizationURL, fiber.StatusFound)
+}
+
+func (h *HTTPHandler) startOIDCFlow(c *fiber.Ctx, oidcProvider *OIDCProvider, state *OIDCState) (string, error) {
+	authorizationURL, errURL := oidcProvider.AuthorizationURL(c.Context(), state)
+	if errURL != nil {
+		return "", errors.Join(OIDCExchangeFailed, errURL)
+	}
+
+	errSave := h.oidcStates.Save(c.Context(), state)
+	if errSave != nil {
+		return "", errSave
+	}
+	setOIDCStateCookie(c, oidcProvider, state.State)
+	return authorizationURL, nil
+}
+
+// OIDCCallback finishes the flow. It accepts both a query string and a form
+// post, since Apple answers with response_mode=form_post.
+func (h *HTTPHandler) OIDCCallback(c *fiber.Ctx) error {
+	providerName := c.Params("provider")
+	oidcProvider, errProvider := h.oidcProviders.Get(providerName)
+	if errProvider != nil {
+		return ErrorResponse(c, fiber.StatusNotFound, errProvider, "oidc-provider-not-found")
+	}
+
+	callbackValue := func(key string) string {
+		if value := c.Query(key); value != "" {
+			return value
+		}
+		return c.FormValue(key)
+	}
+
+	if !oidcStateFromThisBrowser(c, callbackValue("state")) {
+		return ErrorResponse(c, fiber.StatusBadRequest, OIDCStateNotFound, "invalid-oidc-state")
+	}
+
+	state, errTake := h.oidcStates.Take(c.Context(), callbackValue("state"))
+	if errTake != nil {
+		if errors.Is(errTake, OIDCStateNotFound) {
+			return ErrorResponse(c, fiber.StatusBadRequest, errTake, "invalid-oidc-state")
+		}
+		return ErrorResponse(c, fiber.StatusInternalServerError, errTake, "internal-server-error")
+	}
+	if state.Provider != providerName {
+		return ErrorResponse(c, fiber.StatusBadRequest, OIDCStateNotFound, "invalid-oidc-state")
+	}
+
+	if providerError := callbackValue("error"); providerError != "" {
+		return ErrorResponse(c, fiber.StatusUnauthorized, errors.New(providerError), "unauthorized")
+	}
+
+	identity, errExchange := oidcProvider.Exchange(c.Context(), callbackValue("code"), state)
+	if errExchange != nil {
+		if errors.Is(errExchange, InvalidIDToken) {
+			return ErrorResponse(c, fiber.StatusUnauthorized, errExchange, "invalid-id-token")
+		}
+		return ErrorResponse(c, fiber.StatusBadGateway, errExchange, "oidc-exchange-failed")
+	}
+
+	if state.LinkAccountUUID != "" {
+		sessionActive, errSession := h.linkSessionActive(state)
+		if errSession != nil {
+			return ErrorResponse(c, fiber.StatusInternalServerError, errSession, "internal-server-error")
+		}
+		if !sessionActive {
+			return ErrorResponse(c, fiber.StatusBadRequest, OIDCStateNotFound, "invalid-oidc-state")
+		}
+		return h.linkSignedInAccount(c, state.LinkAccountUUID, identity)
+	}
+
+	login, errAuth := h.authenticateWithProvider(c, identity, state.DeviceInfo)
+	if errAuth != nil {
+		return h.providerLoginError(c, errAuth)
+	}
+
+	return h.respondProviderLogin(c, login)
+}
+
+// linkSessionActive reports whether the session that started a provider
+// link is still signed in, so a link cannot outlive a sign-out.
+func (h *HTTPHandler) linkSessionActive(state *OIDCState) (bool, error) {
+	owner, errFind := h.commonuser.Find().ByUUID(state.LinkAccountUUID)
+	if errFind != nil {
+		return false, errFind
+	}
+	sessions, errFetch := h.fetchAccountSessions(owner)
+	if errFetch != nil {
+		return false, errFetch
+	}
+	for _, accountSession := range sessions {
+		if state.LinkSessionID != "" && accountSession.GetRandId() == state.LinkSessionID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// linkSignedInAccount finishes a provider link started from
+// StartProviderLink, once the provider has confirmed the identity.
+func (h *HTTPHandler) linkSignedInAccount(c *fiber.Ctx, accountUUID string, identity *ProviderIdentity) error {
+	owner, errFind := h.commonuser.Find().ByUUID(accountUUID)
+	if errFind != nil {
+		return ErrorResponse(c, fiber.StatusInternalServerError, errFind, "internal-server-error")
+	}
+
+	errLink := h.linkProvider(owner, identity)
+	if errLink != nil {
+		if errors.Is(errLink, ProviderLinkedToOther) {
+			return ErrorResponse(c, fiber.StatusConflict, errLink, "provider-already-linked")
+		}
+		return ErrorResponse(c, fiber.StatusInternalServerError, errLink, "internal-server-error")
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+type linkedProvider struct {
+	UUID   string `json:"uuid"`
+	Issuer string `json:"issuer"`
+	Email  string `json:"email"`
+	Name   string `json:"name"`
+}
+
+func (h *HTTPHandler) FetchProviders(c *fiber.Ctx) error {
+	account := c.Locals("account").(*account.Account)
+
+	providers, errFetch := h.commonuser.Provider().FetchByAccount(account.GetUUID())
+	if errFetch != nil {
+		return errFetch
+	}
+
+	linkedProviders := make([]linkedProvider, 0, len(providers))
+	for _, accountProvider := range providers {
+		linkedProviders = append(linkedProviders, linkedProvider{
+			UUID:   accountProvider.GetUUID(),
+			Issuer: accountProvider.Issuer,
+			Email:  accountProvider.Email,
+			Name:   accountProvider.Name,
+		})
+	}
+
+	return c.JSON(linkedProviders)
+}
+
+func (h *HTTPHandler) LinkGoogle(c *fiber.Ctx) error {
+	account := c.Locals("account").(*account.Account)
+
+	var requestBody LinkWithGoogle
+	if err := c.BodyParser(&requestBody); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "invalid-request-body")
+	}
+	if err := RequestValidator.Validate(requestBody); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "validation-failed")
+	}
+
+	claims, errVerify := h.google.Verify(c.Context(), requestBody.IDToken)
+	if errVerify != nil {
+		if errors.Is(errVerify, EmailNotVerified) {
+			return ErrorResponse(c, fiber.StatusForbidden, errVerify, "email-not-verified")
+		}
+		return ErrorResponse(c, fiber.StatusUnauthorized, errVerify, "invalid-id-token")
+	}
+
+	return h.linkSignedInAccount(c, account.GetUUID(), &ProviderIdentity{
+		Issuer:        "google",
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+		Name:          claims.Name,
+	})
+}
+
+// StartProviderLink begins the OIDC flow for linking a provider to the
+// signed-in account. It answers with the authorization URL rather than a
+// redirect, since the request carries a bearer token the browser redirect
+// would not; the provider then calls back the regular callback route. The
+// state cookie set here and the session id kept in the state tie the
+// callback to the browser and session that asked for the link, so a link URL
+// handed to someone else cannot attach their identity to this account.
+func (h *HTTPHandler) StartProviderLink(c *fiber.Ctx) error {
+	account := c.Locals("account").(*account.Account)
+	sessionId := c.Locals("sessionid").(string)
+
+	oidcProvider, errProvider := h.oidcProviders.Get(c.Params("provider"))
+	if errProvider != nil {
+		return ErrorResponse(c, fiber.StatusNotFound, errProvider, "oidc-provider-not-found")
+	}
+
+	state, errState := NewOIDCState(c.Params("provider"), commonuser.DeviceInfo{})
+	if errState != nil {
+		return ErrorResponse(c, fiber.StatusInternalServerError, errState, "internal-server-error")
+	}
+	state.LinkAccountUUID = account.GetUUID()
+	state.LinkSessionID = sessionId
+
+	authorizationURL, errStart := h.startOIDCFlow(c, oidcProvider, state)
+	if errStart != nil {
+		if errors.Is(errStart, OIDCExchangeFailed) {
+			return ErrorResponse(c, fiber.StatusBadGateway, errStart, "oidc-exchange-failed")
+		}
+		return ErrorResponse(c, fiber.StatusInternalServerError, errStart, "internal-server-error")
+	}
+	return c.JSON(map[string]string{"authorizationURL": authorizationURL})
+}
+
+// UnlinkProvider removes a provider from the account, unless it is the only
+// way left to sign in.
+func (h *HTTPHandler) UnlinkProvider(c *fiber.Ctx) error {
+	account := c.Locals("account").(*account.Account)
+	providerUUID := c.Params("providerUUID")
+
+	providers, errFetch := h.commonuser.Provider().FetchByAccount(account.GetUUID())
+	if errFetch != nil {
+		return errFetch
+	}
+
+	var ownedProvider *provider.Provider
+	for _, accountProvider := range providers {
+		if accountProvider.GetUUID() == providerUUID {
+			ownedProvider = accountProvider
+			break
+		}
+	}
+	if ownedProvider == nil {
+		return ErrorResponse(c, fiber.StatusNotFound, provider.ProviderNotFound, "provider-not-found", "UnlinkProvider")
+	}
+
+	if len(providers) == 1 {
+		userAccount, errFind := h.commonuser.Find().ByUUID(account.GetUUID())
+		if errFind != nil {
+			return errFind
+		}
+		if userAccount.Password == "" {
+			return ErrorResponse(c, fiber.StatusConflict, LastLoginMethod, "last-login-method")
+		}
+	}
+
+	errDelete := h.commonuser.Provider().Delete(h.writeDB, ownedProvider.GetUUID())
+	if errDelete != nil {
+		return errDelete
+	}
+
+	Logger.Info("security-event",
+		"component", LogComponent, "event", "provider-unlinked",
+		"accountUUID", account.GetUUID(), "issuer", ownedProvider.Issuer)
+	return c.SendStatus(fiber.StatusOK)
+}
+
 func (h *HTTPHandler) UpdateAccount(c *fiber.Ctx) error {
 	account := c.Locals("account").(*account.Account)
+	sessionId := c.Locals("sessionid").(string)
 
 	var requestBody UpdateAccount
 	if err := c.BodyParser(&requestBody); err != nil {
 		return ErrorResponse(c, fiber.StatusBadRequest, err, "invalid-request-body")
 	}
+	if err := RequestValidator.Validate(requestBody); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "validation-failed")
+	}
 
 	tx, errInitTx := h.writeDB.Begin()
 	if errInitTx != nil {
@@ -260,51 +997,154 @@ func (h *HTTPHandler) UpdateAccount(c *fiber.Ctx) error {
 		return err
 	}
 
+	if requestBody.Locale != "" {
+		errLocale := h.accountLocales.Set(tx, account.GetUUID(), requestBody.Locale)
+		if errLocale != nil {
+			return ErrorResponse(c, fiber.StatusInternalServerError, errLocale, "internal-server-error")
+		}
+	}
+
+	errCommit := tx.Commit()
+	if errCommit != nil {
+		return errCommit
+	}
+
+	newAccessToken, errGenerate := updatedAccount.GenerateAccessToken(
+		h.commonuser.Config().JWTSecret,
+		h.commonuser.Config().JWTIssuer,
+		h.commonuser.Config().JWTLifespan,
+		sessionId,
+	)
+	if errGenerate != nil {
+		return errGenerate
+	}
+
+	newAccessToken, errStamp := h.keyring.Stamp(newAccessToken)
+	if errStamp != nil {
+		return ErrorResponse(c, fiber.StatusInternalServerError, errStamp, "internal-server-error")
+	}
+
+	return c.JSON(map[string]string{"accessToken": newAccessToken})
+}
+
+func (h *HTTPHandler) Refresh(c *fiber.Ctx) error {
+	refreshToken := c.Cookies("refreshToken")
+	if refreshToken == "" {
+		return ErrorResponse(c, fiber.StatusUnauthorized, nil, "missing-refresh-token")
+	}
+
+	var accountUUID string
+	var family string
+	binding, errResolve := h.refreshTokens.Resolve(c.Context(), refreshToken)
+	if errResolve == nil {
+		accountUUID = binding.AccountUUID
+		family = binding.Family
+	} else if errors.Is(errResolve, RefreshTokenReused) {
+		errRevoke := h.revokeReusedFamily(c, binding)
+		if errRevoke != nil {
+			return ErrorResponse(c, fiber.StatusInternalServerError, errRevoke, "internal-server-error")
+		}
+		return ErrorResponse(c, fiber.StatusUnauthorized, errResolve, "refresh-token-reused")
+	} else if errors.Is(errResolve, RefreshTokenNotFound) {
+		// tokens issued before the refresh index existed: fall back to an
+		// expired but well-signed access token naming the account
+		hintToken := strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
+		if hintToken == "" {
+			return ErrorResponse(c, fiber.StatusUnauthorized, errResolve, "invalid-refresh-token")
+		}
+
+		hintClaims, errHint := h.keyring.ParseExpiredAccessToken(hintToken)
+		if errHint != nil {
+			return ErrorResponse(c, fiber.StatusUnauthorized, errHint, "invalid-refresh-token")
+		}
+		accountUUID = hintClaims.UUID
+	} else {
+		return ErrorResponse(c, fiber.StatusInternalServerError, errResolve, "internal-server-error")
+	}
+
+	userAccount, errFind := h.commonuser.Find().ByUUID(accountUUID)
+	if errFind != nil {
+		if errors.Is(errFind, account.NotFound) {
+			return ErrorResponse(c, fiber.StatusUnauthorized, errFind, "invalid-refresh-token")
+		}
+		return ErrorResponse(c, fiber.StatusInternalServerError, errFind, "internal-server-error")
+	}
+
+	tx, errInitTx := h.writeDB.Begin()
+	if errInitTx != nil {
+		return errInitTx
+	}
+	defer tx.Rollback()
+
+	newAccessToken, newRefreshToken, errRefresh := h.commonuser.Session().Refresh(tx, userAccount, refreshToken)
+	if errRefresh != nil {
+		return ErrorResponse(c, fiber.StatusUnauthorized, errRefresh, "invalid-refresh-token")
+	}
+
 	errCommit := tx.Commit()
 	if errCommit != nil {
-		return errCommit
+		return ErrorResponse(c, fiber.StatusInternalServerError, errCommit, "internal-server-error")
 	}
 
-	newAccessToken, errGenerate := updatedAccount.GenerateAccessToken(
-		h.commonuser.Config().JWTSecret,
-		h.commonuser.Config().JWTIssuer,
-		h.commonuser.Config().JWTLifespan,
-		account.GetUUID(),
-	)
-	if errGenerate != nil {
-		return errGenerate
+	// the old token is retired before the new ones go out, so a client never
+	// holds new tokens while the old one still passes for current
+	if binding != nil {
+		errRetire := h.refreshTokens.Retire(c.Context(), refreshToken, *binding)
+		if errors.Is(errRetire, RefreshTokenReused) {
+			return ErrorResponse(c, fiber.StatusUnauthorized, errRetire, "refresh-token-reused")
+		}
+		if errRetire != nil {
+			return ErrorResponse(c, fiber.StatusInternalServerError, errRetire, "internal-server-error")
+		}
+	}
+
+	newAccessToken, errIssue := h.issueTokens(c, newAccessToken, newRefreshToken, family)
+	if errIssue != nil {
+		return ErrorResponse(c, fiber.StatusInternalServerError, errIssue, "internal-server-error")
 	}
 
 	return c.JSON(map[string]string{"accessToken": newAccessToken})
 }
 
-func (h *HTTPHandler) Refresh(c *fiber.Ctx) error {
-	account := c.Locals("account").(*account.Account)
-	refreshToken := c.Cookies("refreshToken")
-	if refreshToken == "" {
-		return ErrorResponse(c, fiber.StatusUnauthorized, nil, "missing-refresh-token")
+// revokeReusedFamily handles a replayed refresh token: the family's current
+// token stops working and the session it belongs to is revoked, or every
+// session of the account when the policy asks for it.
+func (h *HTTPHandler) revokeReusedFamily(c *fiber.Ctx, binding *RefreshBinding) error {
+	Logger.Warn("security-event",
+		"component", LogComponent, "event", "refresh-token-reuse",
+		"accountUUID", binding.AccountUUID, "sessionId", binding.SessionID, "family", binding.Family,
+		"ip", c.IP(), "userAgent", c.Get("User-Agent"))
+
+	errRevokeFamily := h.refreshTokens.RevokeFamily(c.Context(), binding.Family)
+	if errRevokeFamily != nil {
+		return errRevokeFamily
 	}
 
-	tx, errInitTx := h.writeDB.Begin()
-	if errInitTx != nil {
-		return errInitTx
+	userAccount, errFind := h.commonuser.Find().ByUUID(binding.AccountUUID)
+	if errFind != nil {
+		if errors.Is(errFind, account.NotFound) {
+			return nil
+		}
+		return errFind
 	}
 
-	defer tx.Rollback()
+	sessions, errFetch := h.fetchAccountSessions(userAccount)
+	if errFetch != nil {
+		return errFetch
+	}
 
-	newAccessToken, newRefreshToken, errRefresh := h.commonuser.Session().Refresh(tx, account, refreshToken)
-	if errRefresh != nil {
-		return errRefresh
+	for _, accountSession := range sessions {
+		if !h.sessionConfig.RevokeAllOnRefreshReuse && accountSession.GetRandId() != binding.SessionID {
+			continue
+		}
+
+		errRevoke := h.revokeSession(c, accountSession)
+		if errRevoke != nil {
+			return errRevoke
+		}
 	}
 
-	c.Cookie(&fiber.Cookie{
-		Name:     "refreshToken",
-		Value:    newRefreshToken,
-		HTTPOnly: true,
-		Secure:   true,
-		SameSite: "Strict",
-	})
-	return c.JSON(map[string]string{"accessToken": newAccessToken})
+	return nil
 }
 
 func (h *HTTPHandler) UpdateEmail(c *fiber.Ctx) error {
@@ -314,6 +1154,9 @@ func (h *HTTPHandler) UpdateEmail(c *fiber.Ctx) error {
 	if err := c.BodyParser(&requestBody); err != nil {
 		return ErrorResponse(c, fiber.StatusBadRequest, err, "invalid-request-body")
 	}
+	if err := RequestValidator.Validate(requestBody); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "validation-failed")
+	}
 
 	tx, errInitTx := h.writeDB.Begin()
 	if errInitTx != nil {
@@ -336,11 +1179,21 @@ func (h *HTTPHandler) UpdateEmail(c *fiber.Ctx) error {
 		return errCommit
 	}
 
-	// NOTE: The returned token should be sent to the user's NEW email address
-	// for verification. You should implement email delivery (SMTP, service provider, etc.)
-	// to send this token to requestBody.NewEmail. The user must use this token
-	// in the ValidateEmailUpdate endpoint to confirm the email change.
-	return c.JSON(map[string]string{"token": updateEmail.Token, "revokeToken": updateEmail.RevokeToken})
+	// The new address gets the token that confirms the change, the current
+	// one the token that cancels it, in case the request was not the owner's.
+	h.sendEmail(c, EmailChangeConfirm, requestBody.NewEmail, EmailData{
+		Name:        userAccount.Name,
+		NewEmail:    requestBody.NewEmail,
+		AccountUUID: userAccount.GetUUID(),
+		Code:        updateEmail.Token,
+	})
+	h.sendEmail(c, EmailChangeRevoke, userAccount.Email, EmailData{
+		Name:        userAccount.Name,
+		NewEmail:    requestBody.NewEmail,
+		AccountUUID: userAccount.GetUUID(),
+		Code:        updateEmail.RevokeToken,
+	})
+	return c.SendStatus(fiber.StatusAccepted)
 }
 
 func (h *HTTPHandler) ValidateEmailUpdate(c *fiber.Ctx) error {
@@ -348,6 +1201,9 @@ func (h *HTTPHandler) ValidateEmailUpdate(c *fiber.Ctx) error {
 	if err := c.BodyParser(&requestBody); err != nil {
 		return ErrorResponse(c, fiber.StatusBadRequest, err, "invalid-request-body")
 	}
+	if err := RequestValidator.Validate(requestBody); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "validation-failed")
+	}
 
 	tx, errInitTx := h.writeDB.Begin()
 	if errInitTx != nil {
@@ -357,7 +1213,7 @@ func (h *HTTPHandler) ValidateEmailUpdate(c *fiber.Ctx) error {
 
 	err := h.commonuser.EmailUpdate().ValidateUpdate(tx, requestBody.AccountUUID, requestBody.Token)
 	if err != nil {
-		return err
+		return blameCaller(err, InvalidEmailUpdateToken)
 	}
 
 	errCommit := tx.Commit()
@@ -374,11 +1230,22 @@ func (h *HTTPHandler) ValidateEmailUpdate(c *fiber.Ctx) error {
 		}
 	}
 
+	// the token was mailed to the new address, which proves it
+	errMark := h.verifiedEmails.Mark(h.writeDB, accountFromDB.GetUUID(), accountFromDB.Email)
+	if errMark != nil {
+		return ErrorResponse(c, fiber.StatusInternalServerError, errMark, "internal-server-error")
+	}
+
 	errSeedSessions := h.commonuser.Session().SeedByAccount(accountFromDB)
 	if errSeedSessions != nil {
 		return errSeedSessions
 	}
 
+	errInvalidate := h.sessionCache.InvalidateAccount(c.Context(), accountFromDB.GetUUID())
+	if errInvalidate != nil {
+		return errInvalidate
+	}
+
 	return c.SendStatus(fiber.StatusOK)
 }
 
@@ -387,6 +1254,9 @@ func (h *HTTPHandler) RevokeEmailUpdate(c *fiber.Ctx) error {
 	if err := c.BodyParser(&requestBody); err != nil {
 		return ErrorResponse(c, fiber.StatusBadRequest, err, "invalid-request-body")
 	}
+	if err := RequestValidator.Validate(requestBody); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "validation-failed")
+	}
 
 	tx, errInitTx := h.writeDB.Begin()
 	if errInitTx != nil {
@@ -396,7 +1266,10 @@ func (h *HTTPHandler) RevokeEmailUpdate(c *fiber.Ctx) error {
 
 	err := h.commonuser.EmailUpdate().RevokeUpdate(tx, requestBody.AccountUUID, requestBody.RevokeToken)
 	if err != nil {
-		return ErrorResponse(c, fiber.StatusInternalServerError, err, "failed-revoke")
+		if infrastructureError(err) {
+			return ErrorResponse(c, fiber.StatusInternalServerError, err, "failed-revoke")
+		}
+		return blameCaller(err, InvalidEmailUpdateToken)
 	}
 
 	errCommit := tx.Commit()
@@ -414,6 +1287,12 @@ func (h *HTTPHandler) UpdatePassword(c *fiber.Ctx) error {
 	if err := c.BodyParser(&requestBody); err != nil {
 		return ErrorResponse(c, fiber.StatusBadRequest, err, "invalid-request-body")
 	}
+	if err := RequestValidator.Validate(requestBody); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "validation-failed")
+	}
+	if err := h.passwordPolicy.Check("newPassword", requestBody.NewPassword, account.Name, account.Username, account.Email); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "password-policy")
+	}
 
 	tx, errInitTx := h.writeDB.Begin()
 	if errInitTx != nil {
@@ -421,9 +1300,25 @@ func (h *HTTPHandler) UpdatePassword(c *fiber.Ctx) error {
 	}
 	defer tx.Rollback()
 
+	// Update verifies OldPassword first, so the history cannot be used to
+	// test guesses by someone holding only a stolen access token
 	err := h.commonuser.Password().Update(tx, account.GetUUID(), requestBody.OldPassword, requestBody.NewPassword)
 	if err != nil {
-		return err
+		return blameCaller(err, WrongPassword)
+	}
+
+	// the current password may predate the history, so compare it directly too
+	reused, errHistory := h.passwordHistory.Contains(tx, account.GetUUID(), requestBody.NewPassword)
+	if errHistory != nil {
+		return errHistory
+	}
+	if reused || (h.passwordHistory.Enabled() && requestBody.NewPassword == requestBody.OldPassword) {
+		return ErrorResponse(c, fiber.StatusBadRequest, h.passwordHistory.ReuseError("newPassword"), "password-policy")
+	}
+
+	errRecord := h.passwordHistory.Record(tx, account.GetUUID(), requestBody.NewPassword)
+	if errRecord != nil {
+		return errRecord
 	}
 
 	errCommit := tx.Commit()
@@ -436,14 +1331,80 @@ func (h *HTTPHandler) UpdatePassword(c *fiber.Ctx) error {
 		return errSeedSessions
 	}
 
+	errInvalidate := h.sessionCache.InvalidateAccount(c.Context(), account.GetUUID())
+	if errInvalidate != nil {
+		return errInvalidate
+	}
+
 	return c.SendStatus(fiber.StatusOK)
 }
 
-func (h *HTTPHandler) ForgotPassword(c *fiber.Ctx) error {
-	var requestBody ForgotPassword
+// RequestInitialPassword emails a token for SetInitialPassword to accounts
+// created through a provider, which have no password to confirm with.
+func (h *HTTPHandler) RequestInitialPassword(c *fiber.Ctx) error {
+	account := c.Locals("account").(*account.Account)
+
+	userAccount, errFind := h.commonuser.Find().ByUUID(account.GetUUID())
+	if errFind != nil {
+		return errFind
+	}
+	if userAccount.Password != "" {
+		return ErrorResponse(c, fiber.StatusConflict, PasswordAlreadySet, "password-already-set")
+	}
+	if userAccount.Email == "" {
+		return ErrorResponse(c, fiber.StatusConflict, errors.New("account has no email"), "email-required")
+	}
+
+	tx, errInitTx := h.writeDB.Begin()
+	if errInitTx != nil {
+		return errInitTx
+	}
+	defer tx.Rollback()
+
+	setPassword, err := h.commonuser.Password().RequestReset(tx, userAccount, nil)
+	if err != nil {
+		return err
+	}
+
+	errCommit := tx.Commit()
+	if errCommit != nil {
+		return errCommit
+	}
+
+	h.sendEmail(c, EmailPasswordSet, userAccount.Email, EmailData{
+		Name:        userAccount.Name,
+		AccountUUID: userAccount.GetUUID(),
+		Code:        setPassword.Token,
+	})
+	return c.SendStatus(fiber.StatusAccepted)
+}
+
+// SetInitialPassword lets a provider-only account add a password. It needs
+// either the emailed token or a provider login of the current session within
+// RecentProviderAuthWindow.
+func (h *HTTPHandler) SetInitialPassword(c *fiber.Ctx) error {
+	account := c.Locals("account").(*account.Account)
+	sessionId := c.Locals("sessionid").(string)
+
+	var requestBody SetInitialPassword
 	if err := c.BodyParser(&requestBody); err != nil {
 		return ErrorResponse(c, fiber.StatusBadRequest, err, "invalid-request-body")
 	}
+	if err := RequestValidator.Validate(requestBody); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "validation-failed")
+	}
+
+	userAccount, errFind := h.commonuser.Find().ByUUID(account.GetUUID())
+	if errFind != nil {
+		return errFind
+	}
+	if userAccount.Password != "" {
+		return ErrorResponse(c, fiber.StatusConflict, PasswordAlreadySet, "password-already-set")
+	}
+
+	if err := h.passwordPolicy.Check("newPassword", requestBody.NewPassword, userAccount.Name, userAccount.Username, userAccount.Email); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "password-policy")
+	}
 
 	tx, errInitTx := h.writeDB.Begin()
 	if errInitTx != nil {
@@ -451,12 +1412,93 @@ func (h *HTTPHandler) ForgotPassword(c *fiber.Ctx) error {
 	}
 	defer tx.Rollback()
 
-	account, err := h.commonuser.Find().ByEmail(requestBody.Email)
+	token := requestBody.Token
+	viaRecentAuth := token == ""
+	if viaRecentAuth {
+		recentlyAuthenticated, errRecent := h.recentAuth.Has(c.Context(), sessionId)
+		if errRecent != nil {
+			return errRecent
+		}
+		if !recentlyAuthenticated {
+			return ErrorResponse(c, fiber.StatusForbidden, errors.New("no recent provider login"), "reauthentication-required")
+		}
+
+		// the fresh provider login stands in for the emailed token
+		setPassword, errRequest := h.commonuser.Password().RequestReset(tx, userAccount, nil)
+		if errRequest != nil {
+			return errRequest
+		}
+		token = setPassword.Token
+	}
+
+	err := h.commonuser.Password().ValidateReset(tx, userAccount, requestBody.NewPassword, token)
+	if err != nil {
+		return blameCaller(err, InvalidResetToken)
+	}
+
+	errRecord := h.passwordHistory.Record(tx, userAccount.GetUUID(), requestBody.NewPassword)
+	if errRecord != nil {
+		return errRecord
+	}
+
+	errCommit := tx.Commit()
+	if errCommit != nil {
+		return errCommit
+	}
+
+	// spent only once the password is stored, so a failed write leaves the
+	// provider login usable for another try
+	if viaRecentAuth {
+		if _, errConsume := h.recentAuth.Consume(c.Context(), sessionId); errConsume != nil {
+			return errConsume
+		}
+	}
+
+	errSeedSessions := h.commonuser.Session().SeedByAccount(userAccount)
+	if errSeedSessions != nil {
+		return errSeedSessions
+	}
+
+	errInvalidate := h.sessionCache.InvalidateAccount(c.Context(), userAccount.GetUUID())
+	if errInvalidate != nil {
+		return errInvalidate
+	}
+
+	Logger.Info("security-event",
+		"component", LogComponent, "event", "initial-password-set",
+		"accountUUID", userAccount.GetUUID())
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func (h *HTTPHandler) ForgotPassword(c *fiber.Ctx) error {
+	var requestBody ForgotPassword
+	if err := c.BodyParser(&requestBody); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "invalid-request-body")
+	}
+	if err := RequestValidator.Validate(requestBody); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "validation-failed")
+	}
+
+	// the answer is the same 202 after the same ForgotPasswordResponseTime
+	// whether or not the email is registered. A fixed time rather than burnt
+	// work on the miss path, since a hit does a write and mail, not argon2
+	defer padResponseTime(time.Now(), ForgotPasswordResponseTime)
+
+	userAccount, err := h.commonuser.Find().ByEmail(requestBody.Email)
 	if err != nil {
+		if errors.Is(err, account.NotFound) {
+			return c.SendStatus(fiber.StatusAccepted)
+		}
 		return err
 	}
 
-	resetPassword, err := h.commonuser.Password().RequestReset(tx, account, nil)
+	tx, errInitTx := h.writeDB.Begin()
+	if errInitTx != nil {
+		return errInitTx
+	}
+	defer tx.Rollback()
+
+	resetPassword, err := h.commonuser.Password().RequestReset(tx, userAccount, nil)
 	if err != nil {
 		return err
 	}
@@ -466,12 +1508,35 @@ func (h *HTTPHandler) ForgotPassword(c *fiber.Ctx) error {
 		return errCommit
 	}
 
-	// NOTE: The returned token should be sent to the user's email address
-	// for password reset verification. You should implement email delivery
-	// (SMTP, service provider, etc.) to send this token to requestBody.Email.
-	// The user must use this token in the ResetPassword endpoint to complete
-	// the password reset process.
-	return c.JSON(map[string]string{"token": resetPassword.Token})
+	h.sendEmail(c, EmailPasswordReset, userAccount.Email, EmailData{
+		Name:        userAccount.Name,
+		AccountUUID: userAccount.GetUUID(),
+		Code:        resetPassword.Token,
+	})
+	return c.SendStatus(fiber.StatusAccepted)
+}
+
+// sendEmail renders an email of the given kind in the language of the
+// account in data, or of the request, and sends it with sendMail.
+func (h *HTTPHandler) sendEmail(c *fiber.Ctx, kind string, to string, data EmailData) {
+	language := h.accountLocales.Resolve(c, h.writeDB, data.AccountUUID)
+	message, errRender := h.emailTemplates.Render(kind, language, to, data)
+	if errRender != nil {
+		Logger.Error("mail-error", "component", LogComponent, "kind", kind, "error", errRender.Error())
+		return
+	}
+	h.sendMail(message)
+}
+
+// sendMail delivers in the background, so mail latency neither slows the
+// response nor tells whether a message was sent at all.
+func (h *HTTPHandler) sendMail(message Message) {
+	go func() {
+		errSend := h.mailer.Send(context.Background(), message)
+		if errSend != nil {
+			Logger.Error("mail-error", "component", LogComponent, "subject", message.Subject, "error", errSend.Error())
+		}
+	}()
 }
 
 func (h *HTTPHandler) ResetPassword(c *fiber.Ctx) error {
@@ -479,6 +1544,9 @@ func (h *HTTPHandler) ResetPassword(c *fiber.Ctx) error {
 	if err := c.BodyParser(&requestBody); err != nil {
 		return ErrorResponse(c, fiber.StatusBadRequest, err, "invalid-request-body")
 	}
+	if err := RequestValidator.Validate(requestBody); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "validation-failed")
+	}
 
 	tx, errInitTx := h.writeDB.Begin()
 	if errInitTx != nil {
@@ -493,7 +1561,32 @@ func (h *HTTPHandler) ResetPassword(c *fiber.Ctx) error {
 
 	err = h.commonuser.Password().ValidateReset(tx, userAccount, requestBody.NewPassword, requestBody.Token)
 	if err != nil {
-		return err
+		return blameCaller(err, InvalidResetToken)
+	}
+
+	// the policy and history only run for a caller holding a valid token, so
+	// they cannot be probed with a guessed UUID; failing them rolls it back
+	if err := h.passwordPolicy.Check("newPassword", requestBody.NewPassword, userAccount.Name, userAccount.Username, userAccount.Email); err != nil {
+		return ErrorResponse(c, fiber.StatusBadRequest, err, "password-policy")
+	}
+
+	reused, errHistory := h.passwordHistory.Reused(tx, userAccount.GetUUID(), userAccount.Password, requestBody.NewPassword)
+	if errHistory != nil {
+		return errHistory
+	}
+	if reused {
+		return ErrorResponse(c, fiber.StatusBadRequest, h.passwordHistory.ReuseError("newPassword"), "password-policy")
+	}
+
+	errRecord := h.passwordHistory.Record(tx, userAccount.GetUUID(), requestBody.NewPassword)
+	if errRecord != nil {
+		return errRecord
+	}
+
+	// the reset token was mailed to the account's address, which proves it
+	errMark := h.verifiedEmails.Mark(tx, userAccount.GetUUID(), userAccount.Email)
+	if errMark != nil {
+		return errMark
 	}
 
 	errCommit := tx.Commit()
@@ -506,56 +1599,246 @@ func (h *HTTPHandler) ResetPassword(c *fiber.Ctx) error {
 		return errSeedSessions
 	}
 
+	errInvalidate := h.sessionCache.InvalidateAccount(c.Context(), userAccount.GetUUID())
+	if errInvalidate != nil {
+		return errInvalidate
+	}
+
 	return c.SendStatus(fiber.StatusOK)
 }
 
 func (h *HTTPHandler) FetchContent(c *fiber.Ctx) error {
 	account := c.Locals("account").(*account.Account)
-	sessionId := c.Locals("sessionid").(string)
-
-	// check session validity from cache
-	_, errCheckSession := h.commonuserFetcher.Session().Ping(sessionId)
-	if errCheckSession != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
-	}
 
+	// /content is mounted with a session checker, so the session is known live
 	content := "Hi " + account.Name + ". If you can see this, you are authenticated."
 	return c.SendString(content)
 }
 
-func (h *HTTPHandler) FetchSession(c *fiber.Ctx) error {
-	account := c.Locals("account").(*account.Account)
+// revokeSession revokes a session and evicts it from every instance's
+// in-process session cache.
+func (h *HTTPHandler) revokeSession(c *fiber.Ctx, accountSession *session.Session) error {
+	errRevoke := h.commonuser.Session().Revoke(h.writeDB, accountSession.GetUUID())
+	if errRevoke != nil {
+		return errRevoke
+	}
+	return h.sessionCache.InvalidateSession(c.Context(), accountSession.GetRandId())
+}
 
+// fetchAccountSessions lists the sessions of an account from the cache,
+// seeding it first when commonuser reports it empty.
+func (h *HTTPHandler) fetchAccountSessions(account *account.Account) ([]*session.Session, error) {
 	sessions, errFetch := h.commonuserFetcher.Session().FetchByAccount(account.GetRandId())
 	if errFetch != nil {
 		if errors.Is(errFetch, session.SeedRequired) {
 			errSeed := h.commonuser.Session().SeedByAccount(account)
 			if errSeed != nil {
-				return errSeed
+				return nil, errSeed
 			}
 
 			sessions, errFetch = h.commonuserFetcher.Session().FetchByAccount(account.GetRandId())
 		}
 	}
 
+	return sessions, errFetch
+}
+
+func (h *HTTPHandler) FetchSession(c *fiber.Ctx) error {
+	account := c.Locals("account").(*account.Account)
+
+	sessions, errFetch := h.fetchAccountSessions(account)
+	if errFetch != nil {
+		return errFetch
+	}
+
 	return c.JSON(sessions)
 }
 
 func (h *HTTPHandler) RevokeSession(c *fiber.Ctx) error {
+	account := c.Locals("account").(*account.Account)
+	sessionUUID := c.Params("sessionUUID")
+
+	sessions, errFetch := h.fetchAccountSessions(account)
+	if errFetch != nil {
+		return errFetch
+	}
+
+	// a session of another account is reported exactly like a missing one
+	var ownedSession *session.Session
+	for _, accountSession := range sessions {
+		if accountSession.GetUUID() == sessionUUID {
+			ownedSession = accountSession
+			break
+		}
+	}
+	if ownedSession == nil {
+		return ErrorResponse(c, fiber.StatusNotFound, errors.New("session not found for account"), "session-not-found", "RevokeSession")
+	}
+
+	errRevoke := h.revokeSession(c, ownedSession)
+	if errRevoke != nil {
+		return errRevoke
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// AdminRevokeSession revokes a session of any account. It is only reachable
+// behind MiddlewareRequireAdmin. The session is looked up among the account's
+// sessions for its id, so only that session is evicted from the caches.
+func (h *HTTPHandler) AdminRevokeSession(c *fiber.Ctx) error {
+	admin := c.Locals("account").(*account.Account)
 	sessionUUID := c.Params("sessionUUID")
 
-	errRevoke := h.commonuser.Session().Revoke(h.writeDB, sessionUUID)
+	userAccount, errFind := h.commonuser.Find().ByUUID(c.Params("accountUUID"))
+	if errFind != nil {
+		return errFind
+	}
+
+	sessions, errFetch := h.fetchAccountSessions(userAccount)
+	if errFetch != nil {
+		return errFetch
+	}
+
+	var accountSession *session.Session
+	for _, candidate := range sessions {
+		if candidate.GetUUID() == sessionUUID {
+			accountSession = candidate
+			break
+		}
+	}
+	if accountSession == nil {
+		return ErrorResponse(c, fiber.StatusNotFound, errors.New("session not found for account"), "session-not-found", "AdminRevokeSession")
+	}
+
+	errRevoke := h.revokeSession(c, accountSession)
 	if errRevoke != nil {
 		return errRevoke
 	}
 
+	Logger.Info("admin-action",
+		"component", LogComponent, "action", "revoke-session",
+		"adminUUID", admin.GetUUID(), "accountUUID", userAccount.GetUUID(), "sessionUUID", sessionUUID)
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// forgetRefreshToken invalidates the refresh-token family behind the cookie
+// and clears the cookie on the client.
+func (h *HTTPHandler) forgetRefreshToken(c *fiber.Ctx) error {
+	refreshToken := c.Cookies("refreshToken")
+	if refreshToken != "" {
+		binding, errResolve := h.refreshTokens.Resolve(c.Context(), refreshToken)
+		if binding != nil {
+			errRevoke := h.refreshTokens.RevokeFamily(c.Context(), binding.Family)
+			if errRevoke != nil {
+				return errRevoke
+			}
+		} else if !errors.Is(errResolve, RefreshTokenNotFound) {
+			return errResolve
+		}
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     "refreshToken",
+		Value:    "",
+		Expires:  time.Unix(0, 0),
+		HTTPOnly: true,
+		Secure:   true,
+		SameSite: "Strict",
+	})
+	return nil
+}
+
+func (h *HTTPHandler) Logout(c *fiber.Ctx) error {
+	account := c.Locals("account").(*account.Account)
+	sessionId := c.Locals("sessionid").(string)
+
+	sessions, errFetch := h.fetchAccountSessions(account)
+	if errFetch != nil {
+		return errFetch
+	}
+
+	for _, accountSession := range sessions {
+		if accountSession.GetRandId() != sessionId {
+			continue
+		}
+
+		errRevoke := h.revokeSession(c, accountSession)
+		if errRevoke != nil {
+			return errRevoke
+		}
+	}
+
+	errForget := h.forgetRefreshToken(c)
+	if errForget != nil {
+		return errForget
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// LogoutAll revokes every session of the account. With ?exceptCurrent=true
+// the session making the request stays signed in.
+func (h *HTTPHandler) LogoutAll(c *fiber.Ctx) error {
+	account := c.Locals("account").(*account.Account)
+	sessionId := c.Locals("sessionid").(string)
+	exceptCurrent := c.QueryBool("exceptCurrent", false)
+
+	sessions, errFetch := h.fetchAccountSessions(account)
+	if errFetch != nil {
+		return errFetch
+	}
+
+	for _, accountSession := range sessions {
+		if exceptCurrent && accountSession.GetRandId() == sessionId {
+			continue
+		}
+
+		errRevoke := h.revokeSession(c, accountSession)
+		if errRevoke != nil {
+			return errRevoke
+		}
+	}
+
+	if !exceptCurrent {
+		errForget := h.forgetRefreshToken(c)
+		if errForget != nil {
+			return errForget
+		}
+	}
+
 	return c.SendStatus(fiber.StatusOK)
 }
 
-func NewHTTPHandler(commonuser *commonuser.Service, commonuserFetchers *commonuser.Fetchers, writeDB *sql.DB) *HTTPHandler {
+func (h *HTTPHandler) SessionCacheMetrics(c *fiber.Ctx) error {
+	return c.JSON(h.sessionCache.Metrics())
+}
+
+func (h *HTTPHandler) JWKS(c *fiber.Ctx) error {
+	c.Set("Cache-Control", "public, max-age=300")
+	return c.JSON(h.keyring.JWKS())
+}
+
+func NewHTTPHandler(commonuser *commonuser.Service, commonuserFetchers *commonuser.Fetchers, writeDB *sql.DB, keyring *Keyring, refreshTokens *RefreshTokenStore, sessionConfig SessionConfig, sessionCache *SessionCache, google *GoogleVerifier, oidcProviders OIDCProviders, oidcStates *OIDCStateStore, pendingLinks *PendingLinkStore, providerLinkConfig ProviderLinkConfig, recentAuth *RecentAuthStore, passwordPolicy *PasswordPolicy, passwordHistory *PasswordHistory, mailer Mailer, emailTemplates *EmailTemplates, accountLocales *AccountLocales, verifiedEmails *VerifiedEmails) *HTTPHandler {
 	return &HTTPHandler{
-		commonuser:        commonuser,
-		commonuserFetcher: commonuserFetchers,
-		writeDB:           writeDB,
+		commonuser:         commonuser,
+		commonuserFetcher:  commonuserFetchers,
+		writeDB:            writeDB,
+		keyring:            keyring,
+		refreshTokens:      refreshTokens,
+		sessionConfig:      sessionConfig,
+		sessionCache:       sessionCache,
+		google:             google,
+		oidcProviders:      oidcProviders,
+		oidcStates:         oidcStates,
+		pendingLinks:       pendingLinks,
+		providerLinkConfig: providerLinkConfig,
+		recentAuth:         recentAuth,
+		passwordPolicy:     passwordPolicy,
+		passwordHistory:    passwordHistory,
+		mailer:             mailer,
+		emailTemplates:     emailTemplates,
+		accountLocales:     accountLocales,
+		verifiedEmails:     verifiedEmails,
 	}
 }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var KeyNotFound = errors.New("no key with this kid")
+
+// KeySource hands out the public keys used to verify third-party tokens.
+// Production code fetches a JWKS over HTTP; tests plug in a StaticKeySource.
+type KeySource interface {
+	Key(ctx context.Context, kid string) (crypto.PublicKey, error)
+}
+
+type StaticKeySource map[string]crypto.PublicKey
+
+func (s StaticKeySource) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	key, found := s[kid]
+	if !found {
+		return nil, KeyNotFound
+	}
+	return key, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+
+	switch k.Kty {
+	case "RSA":
+		n, errN := decode(k.N)
+		e, errE := decode(k.E)
+		if errN != nil || errE != nil {
+			return nil, fmt.Errorf("kid %q: malformed RSA key", k.Kid)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("kid %q: unsupported curve %q", k.Kid, k.Crv)
+		}
+		x, errX := decode(k.X)
+		y, errY := decode(k.Y)
+		if errX != nil || errY != nil {
+			return nil, fmt.Errorf("kid %q: malformed EC key", k.Kid)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		x, errX := decode(k.X)
+		if errX != nil || k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("kid %q: malformed OKP key", k.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("kid %q: unsupported key type %q", k.Kid, k.Kty)
+}
+
+// RemoteKeySource caches a JWKS document, honouring the Cache-Control
+// max-age of the response. An unknown kid triggers an early refetch, at most
+// once per minRefetch, to pick up freshly rotated keys. The fetch runs
+// outside the lock and is shared by every caller waiting for it, so lookups
+// of cached keys never wait on the network.
+type RemoteKeySource struct {
+	url        string
+	client     *http.Client
+	defaultTTL time.Duration
+	minRefetch time.Duration
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	expiresAt time.Time
+	fetchedAt time.Time
+	inflight  *keySetFetch
+}
+
+// keySetFetch is one fetch of the key set; done is closed once err is set.
+type keySetFetch struct {
+	done chan struct{}
+	err  error
+}
+
+func NewRemoteKeySource(url string) *RemoteKeySource {
+	return &RemoteKeySource{
+		url:        url,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		defaultTTL: time.Hour,
+		minRefetch: time.Minute,
+	}
+}
+
+func (s *RemoteKeySource) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	now := time.Now()
+	stale := s.keys == nil || now.After(s.expiresAt)
+	key, found := s.keys[kid]
+	recentlyFetched := now.Sub(s.fetchedAt) <= s.minRefetch
+	s.mu.Unlock()
+
+	if !stale && found {
+		return key, nil
+	}
+	if !stale && recentlyFetched {
+		return nil, KeyNotFound
+	}
+
+	if errRefresh := s.refresh(ctx); errRefresh != nil {
+		return nil, errRefresh
+	}
+
+	s.mu.Lock()
+	key, found = s.keys[kid]
+	s.mu.Unlock()
+	if !found {
+		return nil, KeyNotFound
+	}
+	return key, nil
+}
+
+// refresh waits for a fetch of the key set, starting one unless another
+// caller already did. The fetch is not tied to ctx, so a caller giving up
+// does not fail the others.
+func (s *RemoteKeySource) refresh(ctx context.Context) error {
+	s.mu.Lock()
+	call := s.inflight
+	if call == nil {
+		call = &keySetFetch{done: make(chan struct{})}
+		s.inflight = call
+		go s.fetch(call)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *RemoteKeySource) fetch(call *keySetFetch) {
+	keys, ttl, errFetch := s.download()
+
+	s.mu.Lock()
+	if errFetch == nil {
+		now := time.Now()
+		s.keys = keys
+		s.fetchedAt = now
+		s.expiresAt = now.Add(ttl)
+	}
+	s.inflight = nil
+	s.mu.Unlock()
+
+	call.err = errFetch
+	close(call.done)
+}
+
+func (s *RemoteKeySource) download() (map[string]crypto.PublicKey, time.Duration, error) {
+	response, errGet := s.client.Get(s.url)
+	if errGet != nil {
+		return nil, 0, fmt.Errorf("fetch JWKS %s: %w", s.url, errGet)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("fetch JWKS %s: status %d", s.url, response.StatusCode)
+	}
+
+	var document struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if errDecode := json.NewDecoder(response.Body).Decode(&document); errDecode != nil {
+		return nil, 0, fmt.Errorf("decode JWKS %s: %w", s.url, errDecode)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(document.Keys))
+	for _, webKey := range document.Keys {
+		if webKey.Use != "" && webKey.Use != "sig" {
+			continue
+		}
+		publicKey, errKey := webKey.publicKey()
+		if errKey != nil {
+			Logger.Warn("jwks-key-skipped", "component", LogComponent, "url", s.url, "error", errKey.Error())
+			continue
+		}
+		keys[webKey.Kid] = publicKey
+	}
+	return keys, cacheMaxAge(response.Header.Get("Cache-Control"), s.defaultTTL), nil
+}
+
+func cacheMaxAge(cacheControl string, fallback time.Duration) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		value, found := strings.CutPrefix(strings.TrimSpace(directive), "max-age=")
+		if !found {
+			continue
+		}
+		if seconds, errParse := strconv.Atoi(value); errParse == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func rsaJWK(kid string, key *rsa.PublicKey) jsonWebKey {
+	encode := base64.RawURLEncoding.EncodeToString
+	return jsonWebKey{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		N:   encode(key.N.Bytes()),
+		E:   encode(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// jwksServer serves keys as a JWKS document, counting fetches. While gate
+// is non-nil, every fetch waits for it to be closed.
+type jwksServer struct {
+	*httptest.Server
+	fetches atomic.Int32
+	gate    chan struct{}
+	keys    []jsonWebKey
+}
+
+func newJWKSServer(t *testing.T, keys ...jsonWebKey) *jwksServer {
+	server := &jwksServer{keys: keys}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.fetches.Add(1)
+		if server.gate != nil {
+			<-server.gate
+		}
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		json.NewEncoder(w).Encode(map[string]any{"keys": server.keys})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRemoteKeySourceSharesOneFetch(t *testing.T) {
+	key := newTestRSAKey(t)
+	server := newJWKSServer(t, rsaJWK("key-1", &key.PublicKey))
+	server.gate = make(chan struct{})
+	source := NewRemoteKeySource(server.URL)
+
+	var wait sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			_, errKey := source.Key(context.Background(), "key-1")
+			errs <- errKey
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(server.gate)
+	wait.Wait()
+	close(errs)
+
+	for errKey := range errs {
+		if errKey != nil {
+			t.Fatal(errKey)
+		}
+	}
+	if fetches := server.fetches.Load(); fetches != 1 {
+		t.Fatalf("fetched %d times, want 1", fetches)
+	}
+}
+
+func TestRemoteKeySourceCachedKeyDoesNotWaitForRefetch(t *testing.T) {
+	key := newTestRSAKey(t)
+	server := newJWKSServer(t, rsaJWK("key-1", &key.PublicKey))
+	source := NewRemoteKeySource(server.URL)
+	source.minRefetch = 0
+
+	if _, errKey := source.Key(context.Background(), "key-1"); errKey != nil {
+		t.Fatal(errKey)
+	}
+
+	// an unknown kid starts a refetch that hangs until the gate opens
+	server.gate = make(chan struct{})
+	defer close(server.gate)
+	unknownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go source.Key(unknownCtx, "random-kid")
+	time.Sleep(50 * time.Millisecond)
+
+	lookup := make(chan error, 1)
+	go func() {
+		_, errKey := source.Key(context.Background(), "key-1")
+		lookup <- errKey
+	}()
+	select {
+	case errKey := <-lookup:
+		if errKey != nil {
+			t.Fatal(errKey)
+		}
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("cached key lookup blocked behind the refetch")
+	}
+}
+
+func TestRemoteKeySourceUnknownKid(t *testing.T) {
+	key := newTestRSAKey(t)
+	server := newJWKSServer(t, rsaJWK("key-1", &key.PublicKey))
+	source := NewRemoteKeySource(server.URL)
+
+	if _, errKey := source.Key(context.Background(), "key-1"); errKey != nil {
+		t.Fatal(errKey)
+	}
+	// within minRefetch of the last fetch, an unknown kid is not refetched
+	if _, errKey := source.Key(context.Background(), "key-2"); !errors.Is(errKey, KeyNotFound) {
+		t.Fatalf("got %v, want KeyNotFound", errKey)
+	}
+	if fetches := server.fetches.Load(); fetches != 1 {
+		t.Fatalf("fetched %d times, want 1", fetches)
+	}
+
+	source.minRefetch = 0
+	server.keys = append(server.keys, rsaJWK("key-2", &key.PublicKey))
+	if _, errKey := source.Key(context.Background(), "key-2"); errKey != nil {
+		t.Fatalf("rotated key not picked up: %v", errKey)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/21strive/commonuser/jwt_impl"
+	"github.com/golang-jwt/jwt/v5"
+	"math/big"
+	"sync"
+	"time"
+)
+
+var (
+	UnknownSigningKey     = errors.New("unknown signing key")
+	RetiredSigningKey     = errors.New("signing key retired")
+	SigningMethodMismatch = errors.New("token algorithm does not match signing key")
+	MissingKeyID          = errors.New("token has no kid")
+	UnsupportedPEMKey     = errors.New("PEM does not hold an RSA or Ed25519 key")
+)
+
+type SigningKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	RetireAt  time.Time
+	signKey   any
+	verifyKey any
+}
+
+func NewHMACKey(id string, secret string) *SigningKey {
+	return &SigningKey{
+		ID:        id,
+		Method:    jwt.SigningMethodHS256,
+		signKey:   []byte(secret),
+		verifyKey: []byte(secret),
+	}
+}
+
+// ParsePEMKey accepts an RSA or Ed25519 key, private or public. Public-only
+// keys can verify tokens but never sign them.
+func ParsePEMKey(id string, pem string) (*SigningKey, error) {
+	pemBytes := []byte(pem)
+
+	if privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(pemBytes); err == nil {
+		return &SigningKey{ID: id, Method: jwt.SigningMethodRS256, signKey: privateKey, verifyKey: &privateKey.PublicKey}, nil
+	}
+	if privateKey, err := jwt.ParseEdPrivateKeyFromPEM(pemBytes); err == nil {
+		signer := privateKey.(crypto.Signer)
+		return &SigningKey{ID: id, Method: jwt.SigningMethodEdDSA, signKey: signer, verifyKey: signer.Public()}, nil
+	}
+	if publicKey, err := jwt.ParseRSAPublicKeyFromPEM(pemBytes); err == nil {
+		return &SigningKey{ID: id, Method: jwt.SigningMethodRS256, verifyKey: publicKey}, nil
+	}
+	if publicKey, err := jwt.ParseEdPublicKeyFromPEM(pemBytes); err == nil {
+		return &SigningKey{ID: id, Method: jwt.SigningMethodEdDSA, verifyKey: publicKey}, nil
+	}
+
+	return nil, fmt.Errorf("kid %q: %w", id, UnsupportedPEMKey)
+}
+
+func (k *SigningKey) retired(now time.Time) bool {
+	return !k.RetireAt.IsZero() && now.After(k.RetireAt)
+}
+
+func (k *SigningKey) symmetric() bool {
+	_, isHMAC := k.Method.(*jwt.SigningMethodHMAC)
+	return isHMAC
+}
+
+// JWK returns the public JSON Web Key, or nil for HMAC keys which must never
+// be published.
+func (k *SigningKey) JWK() map[string]string {
+	encode := base64.RawURLEncoding.EncodeToString
+
+	switch publicKey := k.verifyKey.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": k.Method.Alg(),
+			"kid": k.ID,
+			"n":   encode(publicKey.N.Bytes()),
+			"e":   encode(big.NewInt(int64(publicKey.E)).Bytes()),
+		}
+	case ed25519.PublicKey:
+		return map[string]string{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"use": "sig",
+			"alg": k.Method.Alg(),
+			"kid": k.ID,
+			"x":   encode(publicKey),
+		}
+	}
+	return nil
+}
+
+// Keyring holds the active signing key plus older keys that can still verify
+// tokens until their retirement time. Every token handed out to a client
+// carries the kid of the key that signed it.
+type Keyring struct {
+	mu     sync.RWMutex
+	active *SigningKey
+	keys   map[string]*SigningKey
+	issuer string
+}
+
+func NewKeyring(jwtConfig JWTConfig) (*Keyring, error) {
+	active := NewHMACKey(jwtConfig.KeyID, jwtConfig.Secret)
+	if jwtConfig.PrivateKey != "" {
+		var errParse error
+		active, errParse = ParsePEMKey(jwtConfig.KeyID, jwtConfig.PrivateKey)
+		if errParse != nil {
+			return nil, errParse
+		}
+		if active.signKey == nil {
+			return nil, fmt.Errorf("kid %q: JWT_PRIVATE_KEY holds a public key", jwtConfig.KeyID)
+		}
+	}
+
+	keyring := &Keyring{
+		active: active,
+		keys:   map[string]*SigningKey{active.ID: active},
+		issuer: jwtConfig.Issuer,
+	}
+
+	bootTime := time.Now()
+	for _, previousKey := range jwtConfig.PreviousKeys {
+		key := NewHMACKey(previousKey.ID, previousKey.Secret)
+		if previousKey.PEM != "" {
+			var errParse error
+			key, errParse = ParsePEMKey(previousKey.ID, previousKey.PEM)
+			if errParse != nil {
+				return nil, errParse
+			}
+		}
+
+		key.RetireAt = previousKey.RetireAt
+		if key.RetireAt.IsZero() {
+			// tokens signed by this key have all expired one lifespan from now
+			key.RetireAt = bootTime.Add(jwtConfig.Lifespan)
+		}
+		keyring.keys[key.ID] = key
+	}
+
+	return keyring, nil
+}
+
+// Prune drops every key whose retirement time has passed.
+func (k *Keyring) Prune() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var pruned []string
+	now := time.Now()
+	for kid, key := range k.keys {
+		if key != k.active && key.retired(now) {
+			delete(k.keys, kid)
+			pruned = append(pruned, kid)
+		}
+	}
+	return pruned
+}
+
+// SchedulePruning runs Prune on every tick until ctx is cancelled.
+func (k *Keyring) SchedulePruning(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				for _, kid := range k.Prune() {
+					Logger.Info("jwt-key-retired", "kid", kid)
+				}
+			}
+		}
+	}()
+}
+
+// Stamp re-signs a token issued by commonuser with the active key, adding its
+// kid to the header. With an asymmetric active key this also switches the
+// token from HS256 to RS256/EdDSA.
+func (k *Keyring) Stamp(accessToken string) (string, error) {
+	claims := jwt.MapClaims{}
+	_, _, errParse := jwt.NewParser().ParseUnverified(accessToken, claims)
+	if errParse != nil {
+		return "", fmt.Errorf("stamp access token: %w", errParse)
+	}
+
+	k.mu.RLock()
+	active := k.active
+	k.mu.RUnlock()
+
+	stamped := jwt.NewWithClaims(active.Method, claims)
+	stamped.Header["kid"] = active.ID
+	return stamped.SignedString(active.signKey)
+}
+
+func (k *Keyring) keyFunc(token *jwt.Token) (any, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	kid, hasKid := token.Header["kid"].(string)
+	if !hasKid {
+		// tokens minted before key rotation was introduced carry no kid
+		if !k.active.symmetric() {
+			return nil, MissingKeyID
+		}
+		kid = k.active.ID
+	}
+
+	key, found := k.keys[kid]
+	if !found {
+		return nil, UnknownSigningKey
+	}
+	if key.retired(time.Now()) {
+		return nil, RetiredSigningKey
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, SigningMethodMismatch
+	}
+	return key.verifyKey, nil
+}
+
+func (k *Keyring) ParseAccessToken(accessToken string) (*jwt_impl.UserClaims, error) {
+	claims := &jwt_impl.UserClaims{}
+	_, errParse := jwt.ParseWithClaims(accessToken, claims, k.keyFunc,
+		jwt.WithValidMethods([]string{"HS256", "RS256", "EdDSA"}),
+		jwt.WithIssuer(k.issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if errParse != nil {
+		return nil, errParse
+	}
+	return claims, nil
+}
+
+// ParseExpiredAccessToken checks signature and issuer but accepts an expired
+// token. Only use it where the token is a hint, never as proof of a session.
+func (k *Keyring) ParseExpiredAccessToken(accessToken string) (*jwt_impl.UserClaims, error) {
+	claims := &jwt_impl.UserClaims{}
+	_, errParse := jwt.ParseWithClaims(accessToken, claims, k.keyFunc,
+		jwt.WithValidMethods([]string{"HS256", "RS256", "EdDSA"}),
+		jwt.WithoutClaimsValidation(),
+	)
+	if errParse != nil {
+		return nil, errParse
+	}
+
+	issuer, errIssuer := claims.GetIssuer()
+	if errIssuer != nil || issuer != k.issuer {
+		return nil, jwt.ErrTokenInvalidIssuer
+	}
+	return claims, nil
+}
+
+// JWKS lists the public half of every asymmetric key that still verifies
+// tokens, in the shape served at /.well-known/jwks.json.
+func (k *Keyring) JWKS() map[string][]map[string]string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keys := []map[string]string{}
+	now := time.Now()
+	for _, key := range k.keys {
+		if key.retired(now) {
+			continue
+		}
+		if jwk := key.JWK(); jwk != nil {
+			keys = append(keys, jwk)
+		}
+	}
+	return map[string][]map[string]string{"keys": keys}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"testing"
+	"time"
+)
+
+const keyringTestIssuer = "keyring-test"
+
+func keyringTestClaims() jwt.MapClaims {
+	return jwt.MapClaims{"iss": keyringTestIssuer, "uuid": "account-1", "exp": time.Now().Add(time.Minute).Unix()}
+}
+
+func signHMACTestToken(t *testing.T, secret string, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, errSign := token.SignedString([]byte(secret))
+	if errSign != nil {
+		t.Fatal(errSign)
+	}
+	return signed
+}
+
+func TestKeyringParseAccessToken(t *testing.T) {
+	rsaKey := newTestRSAKey(t)
+	rsaPEM := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+
+	hmacKeyring, errHMAC := NewKeyring(JWTConfig{KeyID: "hmac-1", Secret: "current-secret", Issuer: keyringTestIssuer, Lifespan: time.Hour})
+	if errHMAC != nil {
+		t.Fatal(errHMAC)
+	}
+	rotatedKeyring, errRotated := NewKeyring(JWTConfig{
+		KeyID:      "rsa-1",
+		PrivateKey: rsaPEM,
+		Issuer:     keyringTestIssuer,
+		Lifespan:   time.Hour,
+		PreviousKeys: []PreviousJWTKey{
+			{ID: "hmac-1", Secret: "current-secret"},
+			{ID: "hmac-0", Secret: "older-secret", RetireAt: time.Now().Add(-time.Minute)},
+		},
+	})
+	if errRotated != nil {
+		t.Fatal(errRotated)
+	}
+
+	expired := keyringTestClaims()
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	otherIssuer := keyringTestClaims()
+	otherIssuer["iss"] = "someone-else"
+
+	cases := []struct {
+		name    string
+		keyring *Keyring
+		token   string
+		wantErr error
+	}{
+		{name: "active hmac kid", keyring: hmacKeyring, token: signHMACTestToken(t, "current-secret", "hmac-1", keyringTestClaims())},
+		{name: "kid-less token while hmac is active", keyring: hmacKeyring, token: signHMACTestToken(t, "current-secret", "", keyringTestClaims())},
+		{name: "unknown kid", keyring: hmacKeyring, token: signHMACTestToken(t, "current-secret", "hmac-9", keyringTestClaims()), wantErr: UnknownSigningKey},
+		{name: "wrong secret", keyring: hmacKeyring, token: signHMACTestToken(t, "guessed-secret", "hmac-1", keyringTestClaims()), wantErr: jwt.ErrTokenSignatureInvalid},
+		{name: "expired", keyring: hmacKeyring, token: signHMACTestToken(t, "current-secret", "hmac-1", expired), wantErr: jwt.ErrTokenExpired},
+		{name: "other issuer", keyring: hmacKeyring, token: signHMACTestToken(t, "current-secret", "hmac-1", otherIssuer), wantErr: jwt.ErrTokenInvalidIssuer},
+		{name: "active rsa kid", keyring: rotatedKeyring, token: signTestToken(t, rsaKey, "rsa-1", keyringTestClaims())},
+		{name: "previous hmac kid", keyring: rotatedKeyring, token: signHMACTestToken(t, "current-secret", "hmac-1", keyringTestClaims())},
+		{name: "kid-less token once rsa is active", keyring: rotatedKeyring, token: signHMACTestToken(t, "current-secret", "", keyringTestClaims()), wantErr: MissingKeyID},
+		{name: "alg mismatch", keyring: rotatedKeyring, token: signHMACTestToken(t, "current-secret", "rsa-1", keyringTestClaims()), wantErr: SigningMethodMismatch},
+		{name: "retired kid", keyring: rotatedKeyring, token: signHMACTestToken(t, "older-secret", "hmac-0", keyringTestClaims()), wantErr: RetiredSigningKey},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			claims, errParse := testCase.keyring.ParseAccessToken(testCase.token)
+			if testCase.wantErr == nil {
+				if errParse != nil {
+					t.Fatal(errParse)
+				}
+				if claims.UUID != "account-1" {
+					t.Fatalf("uuid %q, want account-1", claims.UUID)
+				}
+				return
+			}
+			if !errors.Is(errParse, testCase.wantErr) {
+				t.Fatalf("error %v, want %v", errParse, testCase.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyringStampAndPrune(t *testing.T) {
+	rsaKey := newTestRSAKey(t)
+	rsaPEM := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+	keyring, errKeyring := NewKeyring(JWTConfig{
+		KeyID:      "rsa-1",
+		PrivateKey: rsaPEM,
+		Issuer:     keyringTestIssuer,
+		Lifespan:   time.Hour,
+		PreviousKeys: []PreviousJWTKey{
+			{ID: "hmac-1", Secret: "current-secret"},
+			{ID: "hmac-0", Secret: "older-secret", RetireAt: time.Now().Add(-time.Minute)},
+		},
+	})
+	if errKeyring != nil {
+		t.Fatal(errKeyring)
+	}
+
+	// a library-issued HS256 token comes out as RS256 under the active kid
+	stamped, errStamp := keyring.Stamp(signHMACTestToken(t, "library-secret", "", keyringTestClaims()))
+	if errStamp != nil {
+		t.Fatal(errStamp)
+	}
+	token, _, errUnverified := jwt.NewParser().ParseUnverified(stamped, jwt.MapClaims{})
+	if errUnverified != nil {
+		t.Fatal(errUnverified)
+	}
+	if token.Method.Alg() != "RS256" || token.Header["kid"] != "rsa-1" {
+		t.Fatalf("stamped with %s kid %v, want RS256 kid rsa-1", token.Method.Alg(), token.Header["kid"])
+	}
+	if _, errParse := keyring.ParseAccessToken(stamped); errParse != nil {
+		t.Fatal(errParse)
+	}
+
+	if jwks := keyring.JWKS()["keys"]; len(jwks) != 1 || jwks[0]["kid"] != "rsa-1" {
+		t.Fatalf("JWKS %v, want only rsa-1", jwks)
+	}
+
+	pruned := keyring.Prune()
+	if len(pruned) != 1 || pruned[0] != "hmac-0" {
+		t.Fatalf("pruned %v, want [hmac-0]", pruned)
+	}
+	_, errParse := keyring.ParseAccessToken(signHMACTestToken(t, "older-secret", "hmac-0", keyringTestClaims()))
+	if !errors.Is(errParse, UnknownSigningKey) {
+		t.Fatalf("error %v after pruning, want UnknownSigningKey", errParse)
+	}
+}
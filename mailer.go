@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/21strive/item"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	MailBackendSMTP = "smtp"
+	MailBackendFile = "file"
+
+	SMTPSecurityStartTLS = "starttls"
+	SMTPSecurityTLS      = "tls"
+	SMTPSecurityNone     = "none"
+)
+
+// Message is one outgoing email. HTML is optional; when set the email is
+// sent as multipart/alternative with Text as the plain text part.
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer delivers the emails carrying verification codes and tokens, which
+// must never be returned in an HTTP response.
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// NewMailer builds the backend selected by MailConfig.Backend.
+func NewMailer(config MailConfig) (Mailer, error) {
+	switch config.Backend {
+	case MailBackendSMTP:
+		return NewSMTPMailer(config), nil
+	case MailBackendFile:
+		return NewFileMailer(config.From, config.CaptureDir)
+	}
+	return nil, fmt.Errorf("unknown mail backend %q", config.Backend)
+}
+
+// rfc822 renders message as a UTF-8 email, with quoted-printable parts.
+func (m Message) rfc822(from string) ([]byte, error) {
+	var buffer bytes.Buffer
+	header := func(name string, value string) {
+		buffer.WriteString(name + ": " + value + "\r\n")
+	}
+
+	header("From", from)
+	header("To", m.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", "<"+item.RandId()+"@"+mailDomain(from)+">")
+	header("MIME-Version", "1.0")
+
+	if m.HTML == "" {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buffer.WriteString("\r\n")
+		if errWrite := writeQuotedPrintable(&buffer, m.Text); errWrite != nil {
+			return nil, errWrite
+		}
+		return buffer.Bytes(), nil
+	}
+
+	parts := multipart.NewWriter(&buffer)
+	header("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	buffer.WriteString("\r\n")
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		writer, errPart := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if errPart != nil {
+			return nil, errPart
+		}
+		if errWrite := writeQuotedPrintable(writer, part.body); errWrite != nil {
+			return nil, errWrite
+		}
+	}
+	if errClose := parts.Close(); errClose != nil {
+		return nil, errClose
+	}
+	return buffer.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, text string) error {
+	body := quotedprintable.NewWriter(w)
+	if _, errWrite := body.Write([]byte(strings.ReplaceAll(text, "\n", "\r\n"))); errWrite != nil {
+		return errWrite
+	}
+	return body.Close()
+}
+
+func mailDomain(from string) string {
+	if address, errParse := mail.ParseAddress(from); errParse == nil {
+		if at := strings.LastIndex(address.Address, "@"); at != -1 {
+			return address.Address[at+1:]
+		}
+	}
+	return "localhost"
+}
+
+// SMTPMailer delivers through an SMTP relay, over STARTTLS, implicit TLS or,
+// for local relays only, plain text.
+type SMTPMailer struct {
+	config MailConfig
+}
+
+func NewSMTPMailer(config MailConfig) *SMTPMailer {
+	return &SMTPMailer{config: config}
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, message Message) error {
+	payload, errRender := message.rfc822(m.config.From)
+	if errRender != nil {
+		return errRender
+	}
+
+	address := net.JoinHostPort(m.config.SMTPHost, m.config.SMTPPort)
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	tlsConfig := &tls.Config{ServerName: m.config.SMTPHost}
+
+	var conn net.Conn
+	var errDial error
+	if m.config.SMTPSecurity == SMTPSecurityTLS {
+		conn, errDial = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", address)
+	} else {
+		conn, errDial = dialer.DialContext(ctx, "tcp", address)
+	}
+	if errDial != nil {
+		return fmt.Errorf("smtp dial %s: %w", address, errDial)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(time.Minute))
+	}
+
+	client, errClient := smtp.NewClient(conn, m.config.SMTPHost)
+	if errClient != nil {
+		conn.Close()
+		return errClient
+	}
+	defer client.Close()
+
+	if m.config.SMTPSecurity == SMTPSecurityStartTLS {
+		if errTLS := client.StartTLS(tlsConfig); errTLS != nil {
+			return fmt.Errorf("smtp starttls: %w", errTLS)
+		}
+	}
+	if m.config.SMTPUsername != "" {
+		auth := smtp.PlainAuth("", m.config.SMTPUsername, m.config.SMTPPassword, m.config.SMTPHost)
+		if errAuth := client.Auth(auth); errAuth != nil {
+			return fmt.Errorf("smtp auth: %w", errAuth)
+		}
+	}
+
+	sender, errSender := mail.ParseAddress(m.config.From)
+	if errSender != nil {
+		return errSender
+	}
+	if errMail := client.Mail(sender.Address); errMail != nil {
+		return errMail
+	}
+	if errRcpt := client.Rcpt(message.To); errRcpt != nil {
+		return errRcpt
+	}
+	writer, errData := client.Data()
+	if errData != nil {
+		return errData
+	}
+	if _, errWrite := writer.Write(payload); errWrite != nil {
+		writer.Close()
+		return errWrite
+	}
+	if errClose := writer.Close(); errClose != nil {
+		return errClose
+	}
+	return client.Quit()
+}
+
+// FileMailer writes every message as an .eml file into a directory, for
+// development: the files open in any mail client.
+type FileMailer struct {
+	from string
+	dir  string
+}
+
+func NewFileMailer(from string, dir string) (*FileMailer, error) {
+	if errMkdir := os.MkdirAll(dir, 0o700); errMkdir != nil {
+		return nil, errMkdir
+	}
+	return &FileMailer{from: from, dir: dir}, nil
+}
+
+func (m *FileMailer) Send(ctx context.Context, message Message) error {
+	payload, errRender := message.rfc822(m.from)
+	if errRender != nil {
+		return errRender
+	}
+
+	name := time.Now().UTC().Format("20060102T150405.000000000") + "-" + item.RandId() + ".eml"
+	return os.WriteFile(filepath.Join(m.dir, name), payload, 0o600)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"github.com/gofiber/fiber/v2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryMailer keeps sent messages in memory instead of delivering them.
+type memoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (m *memoryMailer) Send(ctx context.Context, message Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, message)
+	return nil
+}
+
+// waitForMessages returns the messages once count of them were sent; sendMail
+// delivers in the background.
+func (m *memoryMailer) waitForMessages(t *testing.T, count int) []Message {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		m.mu.Lock()
+		messages := append([]Message(nil), m.messages...)
+		m.mu.Unlock()
+		if len(messages) >= count {
+			return messages
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("fewer than %d messages sent", count)
+	return nil
+}
+
+func TestSendEmailInRequestLanguage(t *testing.T) {
+	emailTemplates, errTemplates := LoadEmailTemplates("Commonuser")
+	if errTemplates != nil {
+		t.Fatal(errTemplates)
+	}
+	mailer := &memoryMailer{}
+	handler := &HTTPHandler{
+		writeDB:        newEmptyDB(t),
+		mailer:         mailer,
+		emailTemplates: emailTemplates,
+		accountLocales: NewAccountLocales(),
+	}
+	app := fiber.New()
+	app.Post("/forgot", func(c *fiber.Ctx) error {
+		handler.sendEmail(c, EmailPasswordReset, "ada@example.com", EmailData{Name: "Ada", AccountUUID: "a1", Code: "reset-token"})
+		return c.SendStatus(fiber.StatusAccepted)
+	})
+
+	// the account has no stored locale, so the request's language is used
+	request := httptest.NewRequest(http.MethodPost, "/forgot", nil)
+	request.Header.Set(fiber.HeaderAcceptLanguage, "id")
+	if _, errTest := app.Test(request, -1); errTest != nil {
+		t.Fatal(errTest)
+	}
+
+	message := mailer.waitForMessages(t, 1)[0]
+	want, errRender := emailTemplates.Render(EmailPasswordReset, "id", "ada@example.com", EmailData{Name: "Ada", Code: "reset-token"})
+	if errRender != nil {
+		t.Fatal(errRender)
+	}
+	if message.To != "ada@example.com" || message.Subject != want.Subject {
+		t.Fatalf("sent %q to %s, want %q", message.Subject, message.To, want.Subject)
+	}
+	if !strings.Contains(message.Text, "reset-token") {
+		t.Fatal("the token is not in the email")
+	}
+}
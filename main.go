@@ -1,56 +1,148 @@
 package main
 
 import (
+	"context"
 	"github.com/21strive/commonuser"
 	"github.com/21strive/commonuser/config"
 	"github.com/gofiber/fiber/v2"
 	_ "github.com/lib/pq"
+	"log"
 	"os"
 	"time"
 )
 
-var SystemJWTSecret = "sgfhd0f2-ujfk2ws"
-var SystemJWTIssuer = "commonuser-api.com"
-var SystemJWTLifespan = 24 * 14 * time.Hour // 14 days
-
 func main() {
+	if len(os.Args) > 1 {
+		if errCommand := runCommand(os.Args[1], os.Args[2:]); errCommand != nil {
+			log.Fatal(errCommand)
+		}
+		return
+	}
+
+	appConfig, errConfig := LoadAppConfig()
+	if errConfig != nil {
+		log.Fatal(errConfig)
+	}
+	ErrorDocsBaseURL = appConfig.ErrorDocsURL
+	LogComponent = appConfig.Log.Component
+	LogRedactor.AddFields(appConfig.Log.RedactFields...)
+
 	writeDB := CreatePostgresConnection(
-		os.Getenv("DB_WRITE_HOST"), os.Getenv("DB_WRITE_PORT"), os.Getenv("DB_WRITE_USER"),
-		os.Getenv("DB_WRITE_PASSWORD"), os.Getenv("DB_WRITE_NAME"), os.Getenv("DB_WRITE_SSLMODE"))
+		appConfig.WriteDB.Host, appConfig.WriteDB.Port, appConfig.WriteDB.User,
+		appConfig.WriteDB.Password, appConfig.WriteDB.Name, appConfig.WriteDB.SSLMode)
 	defer writeDB.Close()
 	readDB := CreatePostgresConnection(
-		os.Getenv("DB_READ_HOST"), os.Getenv("DB_READ_PORT"), os.Getenv("DB_READ_USER"),
-		os.Getenv("DB_READ_PASSWORD"), os.Getenv("DB_READ_NAME"), os.Getenv("DB_READ_SSLMODE"))
+		appConfig.ReadDB.Host, appConfig.ReadDB.Port, appConfig.ReadDB.User,
+		appConfig.ReadDB.Password, appConfig.ReadDB.Name, appConfig.ReadDB.SSLMode)
 	defer readDB.Close()
-	redis := ConnectRedis(os.Getenv("REDIS_HOST"), os.Getenv("REDIS_USER"),
-		os.Getenv("REDIS_PASS"), false)
+	redis := ConnectRedis(appConfig.Redis.Host, appConfig.Redis.Username,
+		appConfig.Redis.Password, appConfig.Redis.Clustered)
 
-	config := config.DefaultConfig("account", SystemJWTSecret, SystemJWTIssuer, SystemJWTLifespan)
+	keyring, errKeyring := NewKeyring(appConfig.JWT)
+	if errKeyring != nil {
+		log.Fatal(errKeyring)
+	}
+	keyring.SchedulePruning(context.Background(), time.Hour)
+
+	config := config.DefaultConfig("account", appConfig.JWT.Secret, appConfig.JWT.Issuer, appConfig.JWT.Lifespan)
 
 	commonuserService := commonuser.New(readDB, redis, config)
 	commonuserFetchers := commonuser.NewFetchers(redis, config)
-	httpHandler := NewHTTPHandler(commonuserService, commonuserFetchers, writeDB)
+	refreshTokens := NewRefreshTokenStore(redis, config.TokenLifespan)
+	sessionCache := NewSessionCache(redis, appConfig.Session.CacheTTL, appConfig.Session.CacheMaxEntries)
+	sessionCache.Subscribe(context.Background())
+	googleVerifier := NewGoogleVerifier(NewRemoteKeySource(appConfig.Google.JWKSURL), appConfig.Google.ClientIDs)
+	oidcProviders := NewOIDCProviders(appConfig.OIDC)
+	oidcStates := NewOIDCStateStore(redis)
+	pendingLinks := NewPendingLinkStore(redis)
+	recentAuth := NewRecentAuthStore(redis)
+	var breachedPasswords *BreachedPasswords
+	if appConfig.Password.BreachedFile != "" {
+		var errBreached error
+		breachedPasswords, errBreached = LoadBreachedPasswords(appConfig.Password.BreachedFile)
+		if errBreached != nil {
+			log.Fatal(errBreached)
+		}
+	}
+	passwordPolicy := NewPasswordPolicy(appConfig.Password, breachedPasswords)
+	mailer, errMailer := NewMailer(appConfig.Mail)
+	if errMailer != nil {
+		log.Fatal(errMailer)
+	}
+	if appConfig.Mail.Backend != MailBackendSMTP {
+		log.Printf("MAIL_BACKEND is %q: emails are not delivered", appConfig.Mail.Backend)
+	}
+	passwordHistory := NewPasswordHistory(appConfig.Password.HistorySize)
+	if errSchema := passwordHistory.EnsureSchema(writeDB); errSchema != nil {
+		log.Fatal(errSchema)
+	}
+	emailTemplates, errTemplates := LoadEmailTemplates(appConfig.Mail.ProductName)
+	if errTemplates != nil {
+		log.Fatal(errTemplates)
+	}
+	accountLocales := NewAccountLocales()
+	if errSchema := accountLocales.EnsureSchema(writeDB); errSchema != nil {
+		log.Fatal(errSchema)
+	}
+	verifiedEmails := NewVerifiedEmails()
+	if errSchema := verifiedEmails.EnsureSchema(writeDB); errSchema != nil {
+		log.Fatal(errSchema)
+	}
+	httpHandler := NewHTTPHandler(commonuserService, commonuserFetchers, writeDB, keyring, refreshTokens, appConfig.Session, sessionCache, googleVerifier, oidcProviders, oidcStates, pendingLinks, appConfig.ProviderLink, recentAuth, passwordPolicy, passwordHistory, mailer, emailTemplates, accountLocales, verifiedEmails)
+
+	sessionChecker := NewSessionChecker(commonuserService, commonuserFetchers, sessionCache)
+	strictTokenAuth := MiddlewareTokenAuth(keyring, sessionChecker)
+	tokenAuth := strictTokenAuth
+	if !appConfig.Session.VerifyOnEveryRequest {
+		tokenAuth = MiddlewareTokenAuth(keyring, nil)
+	}
+	requireAdmin := MiddlewareRequireAdmin(appConfig.Admin)
 
-	app := fiber.New()
+	app := fiber.New(fiber.Config{
+		ErrorHandler: ErrorHandler,
+	})
 
 	app.Post("/register", httpHandler.Registration)
-	app.Post("/register/verify", MiddlewareTokenAuth, httpHandler.VerifyRegistration)
+	app.Post("/register/verify", tokenAuth, httpHandler.VerifyRegistration)
 	app.Post("/auth/username", httpHandler.AuthWithUsername)
-	app.Post("/auth/google", httpHandler.AuthWithGoogle)
+	if len(appConfig.Google.ClientIDs) > 0 {
+		app.Post("/auth/google", httpHandler.AuthWithGoogle)
+	}
 	app.Post("/auth/email", httpHandler.AuthWithEmail)
-	app.Patch("/account", MiddlewareTokenAuth, httpHandler.UpdateAccount)
+	app.Post("/auth/link/confirm", httpHandler.ConfirmProviderLink)
+	if len(oidcProviders) > 0 {
+		app.Get("/auth/:provider/start", httpHandler.OIDCStart)
+		app.Get("/auth/:provider/callback", httpHandler.OIDCCallback)
+		app.Post("/auth/:provider/callback", httpHandler.OIDCCallback)
+	}
+	app.Patch("/account", strictTokenAuth, httpHandler.UpdateAccount)
+	app.Get("/account/providers", tokenAuth, httpHandler.FetchProviders)
+	if len(appConfig.Google.ClientIDs) > 0 {
+		app.Post("/account/providers/google", strictTokenAuth, httpHandler.LinkGoogle)
+	}
+	if len(oidcProviders) > 0 {
+		app.Post("/account/providers/:provider/start", strictTokenAuth, httpHandler.StartProviderLink)
+	}
+	app.Delete("/account/providers/:providerUUID", strictTokenAuth, httpHandler.UnlinkProvider)
 	app.Patch("/refresh", httpHandler.Refresh)
-	app.Post("/email/update", MiddlewareTokenAuth, httpHandler.UpdateEmail)
+	app.Post("/email/update", strictTokenAuth, httpHandler.UpdateEmail)
 	app.Post("/email/update/validate", httpHandler.ValidateEmailUpdate)
 	app.Post("/email/update/revoke", httpHandler.RevokeEmailUpdate)
-	app.Post("/password/update", MiddlewareTokenAuth, httpHandler.UpdatePassword)
+	app.Post("/password/update", strictTokenAuth, httpHandler.UpdatePassword)
+	app.Post("/password/set/request", strictTokenAuth, httpHandler.RequestInitialPassword)
+	app.Post("/password/set", strictTokenAuth, httpHandler.SetInitialPassword)
 	app.Post("/password/forgot", httpHandler.ForgotPassword)
 	app.Post("/password/reset", httpHandler.ResetPassword)
-	app.Get("/session", MiddlewareTokenAuth, httpHandler.FetchSession)
-	app.Post("/session/revoke/:sessionUUID", MiddlewareTokenAuth, httpHandler.RevokeSession)
-	app.Get("/content", MiddlewareTokenAuth, httpHandler.FetchContent)
+	app.Get("/session", tokenAuth, httpHandler.FetchSession)
+	app.Post("/logout", tokenAuth, httpHandler.Logout)
+	app.Post("/logout/all", strictTokenAuth, httpHandler.LogoutAll)
+	app.Post("/session/revoke/:sessionUUID", strictTokenAuth, httpHandler.RevokeSession)
+	app.Post("/admin/account/:accountUUID/session/revoke/:sessionUUID", strictTokenAuth, requireAdmin, httpHandler.AdminRevokeSession)
+	app.Get("/admin/metrics/session-cache", strictTokenAuth, requireAdmin, httpHandler.SessionCacheMetrics)
+	app.Get("/content", strictTokenAuth, httpHandler.FetchContent)
+	app.Get("/.well-known/jwks.json", httpHandler.JWKS)
 
-	err := app.Listen(":3000")
+	err := app.Listen(appConfig.ListenAddr)
 	if err != nil {
 		panic(err)
 	}
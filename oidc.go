@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/21strive/commonuser"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const OIDCStateLifespan = 10 * time.Minute
+
+var (
+	OIDCProviderNotFound = errors.New("OIDC provider not configured")
+	OIDCStateNotFound    = errors.New("OIDC state unknown or expired")
+	OIDCExchangeFailed   = errors.New("OIDC code exchange failed")
+)
+
+// ProviderIdentity is what every login provider resolves to once its token
+// has been verified, whatever the provider's own claim names are.
+type ProviderIdentity struct {
+	Issuer        string `json:"issuer"`
+	Subject       string `json:"subject"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"emailVerified"`
+	Name          string `json:"name"`
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCProvider runs the authorization code + PKCE flow against one provider.
+// Endpoints come from the issuer's discovery document unless set explicitly,
+// which is how plain OAuth2 providers such as GitHub are supported: without a
+// JWKS the identity is read from the userinfo endpoint instead of an ID token.
+// Like RemoteKeySource, the discovery fetch runs outside the lock and is
+// shared by every caller waiting for it.
+type OIDCProvider struct {
+	config OIDCProviderConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      KeySource
+	inflight  *discoveryFetch
+}
+
+// discoveryFetch is one fetch of the discovery document; done is closed once
+// err is set.
+type discoveryFetch struct {
+	done chan struct{}
+	err  error
+}
+
+func NewOIDCProvider(config OIDCProviderConfig) *OIDCProvider {
+	return &OIDCProvider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *OIDCProvider) endpoints(ctx context.Context) (*oidcDiscovery, KeySource, error) {
+	p.mu.Lock()
+	if discovery, keys := p.discovery, p.keys; discovery != nil {
+		p.mu.Unlock()
+		return discovery, keys, nil
+	}
+	call := p.inflight
+	if call == nil {
+		call = &discoveryFetch{done: make(chan struct{})}
+		p.inflight = call
+		go p.fetchDiscovery(call)
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-call.done:
+		if call.err != nil {
+			return nil, nil, call.err
+		}
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.discovery, p.keys, nil
+}
+
+// fetchDiscovery is not tied to a request context, so a caller giving up
+// does not fail the others. A failed fetch is not kept and the next caller
+// tries again.
+func (p *OIDCProvider) fetchDiscovery(call *discoveryFetch) {
+	discovery, errDiscover := p.discover()
+
+	p.mu.Lock()
+	if errDiscover == nil {
+		p.discovery = discovery
+		if discovery.JWKSURI != "" {
+			p.keys = NewRemoteKeySource(discovery.JWKSURI)
+		}
+	}
+	p.inflight = nil
+	p.mu.Unlock()
+
+	call.err = errDiscover
+	close(call.done)
+}
+
+func (p *OIDCProvider) discover() (*oidcDiscovery, error) {
+	discovery := &oidcDiscovery{Issuer: p.config.Issuer}
+	if p.config.Issuer != "" {
+		discoveryURL := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+		if errFetch := p.getJSON(context.Background(), discoveryURL, "", discovery); errFetch != nil {
+			return nil, errFetch
+		}
+		// OIDC Discovery 4.3: the document must name the issuer it was
+		// fetched for, or its keys could vouch for another issuer's tokens
+		if discovery.Issuer != p.config.Issuer {
+			return nil, fmt.Errorf("provider %s: discovery document is for issuer %q, not %q", p.config.Name, discovery.Issuer, p.config.Issuer)
+		}
+	}
+
+	if p.config.AuthURL != "" {
+		discovery.AuthorizationEndpoint = p.config.AuthURL
+	}
+	if p.config.TokenURL != "" {
+		discovery.TokenEndpoint = p.config.TokenURL
+	}
+	if p.config.UserinfoURL != "" {
+		discovery.UserinfoEndpoint = p.config.UserinfoURL
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" {
+		return nil, fmt.Errorf("provider %s: authorization or token endpoint missing", p.config.Name)
+	}
+	return discovery, nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, endpoint string, bearer string, target any) error {
+	request, errRequest := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if errRequest != nil {
+		return errRequest
+	}
+	request.Header.Set("Accept", "application/json")
+	if bearer != "" {
+		request.Header.Set("Authorization", "Bearer "+bearer)
+	}
+
+	response, errDo := p.client.Do(request)
+	if errDo != nil {
+		return fmt.Errorf("GET %s: %w", endpoint, errDo)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", endpoint, response.StatusCode)
+	}
+	return json.NewDecoder(response.Body).Decode(target)
+}
+
+// AuthorizationURL builds the redirect for /auth/:provider/start.
+func (p *OIDCProvider) AuthorizationURL(ctx context.Context, state *OIDCState) (string, error) {
+	discovery, _, errEndpoints := p.endpoints(ctx)
+	if errEndpoints != nil {
+		return "", errEndpoints
+	}
+
+	challenge := sha256.Sum256([]byte(state.CodeVerifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state.State},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	if p.config.ResponseMode != "" {
+		query.Set("response_mode", p.config.ResponseMode)
+	}
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// FormPost reports whether the provider posts the callback cross-site, as
+// Apple does, instead of redirecting the browser to it.
+func (p *OIDCProvider) FormPost() bool {
+	return p.config.ResponseMode == "form_post"
+}
+
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	Error       string `json:"error"`
+}
+
+// Exchange trades the authorization code for tokens and resolves the
+// identity, from the verified ID token when the provider issues one.
+func (p *OIDCProvider) Exchange(ctx context.Context, code string, state *OIDCState) (*ProviderIdentity, error) {
+	discovery, keys, errEndpoints := p.endpoints(ctx)
+	if errEndpoints != nil {
+		return nil, errEndpoints
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"client_secret": {p.config.ClientSecret},
+		"code_verifier": {state.CodeVerifier},
+	}
+	request, errRequest := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if errRequest != nil {
+		return nil, errRequest
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+
+	response, errDo := p.client.Do(request)
+	if errDo != nil {
+		return nil, errors.Join(OIDCExchangeFailed, errDo)
+	}
+	defer response.Body.Close()
+
+	body, errRead := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if errRead != nil {
+		return nil, errors.Join(OIDCExchangeFailed, errRead)
+	}
+
+	var tokens oidcTokenResponse
+	if errDecode := json.Unmarshal(body, &tokens); errDecode != nil {
+		return nil, errors.Join(OIDCExchangeFailed, errDecode)
+	}
+	if response.StatusCode != http.StatusOK || tokens.Error != "" {
+		return nil, fmt.Errorf("%w: status %d %s", OIDCExchangeFailed, response.StatusCode, tokens.Error)
+	}
+
+	if tokens.IDToken != "" && keys != nil {
+		return p.verifyIDToken(ctx, discovery, keys, tokens.IDToken, state.Nonce)
+	}
+	if discovery.UserinfoEndpoint == "" || tokens.AccessToken == "" {
+		return nil, fmt.Errorf("%w: no ID token and no userinfo endpoint", OIDCExchangeFailed)
+	}
+	return p.userinfo(ctx, discovery.UserinfoEndpoint, tokens.AccessToken)
+}
+
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, discovery *oidcDiscovery, keys KeySource, idToken string, nonce string) (*ProviderIdentity, error) {
+	claims := jwt.MapClaims{}
+	_, errParse := jwt.ParseWithClaims(idToken, claims,
+		func(token *jwt.Token) (any, error) {
+			kid, _ := token.Header["kid"].(string)
+			return keys.Key(ctx, kid)
+		},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "EdDSA"}),
+		jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(p.config.ClientID),
+		jwt.WithExpirationRequired(),
+	)
+	if errParse != nil {
+		return nil, errors.Join(InvalidIDToken, errParse)
+	}
+
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", InvalidIDToken)
+	}
+	return p.identityFromClaims(claims)
+}
+
+func (p *OIDCProvider) userinfo(ctx context.Context, endpoint string, accessToken string) (*ProviderIdentity, error) {
+	claims := map[string]any{}
+	if errFetch := p.getJSON(ctx, endpoint, accessToken, &claims); errFetch != nil {
+		return nil, errors.Join(OIDCExchangeFailed, errFetch)
+	}
+	return p.identityFromClaims(claims)
+}
+
+func (p *OIDCProvider) identityFromClaims(claims map[string]any) (*ProviderIdentity, error) {
+	subject := claimString(claims[p.config.SubjectClaim])
+	if subject == "" {
+		return nil, fmt.Errorf("%w: claim %q missing", InvalidIDToken, p.config.SubjectClaim)
+	}
+
+	identity := &ProviderIdentity{
+		Issuer:  p.config.Name,
+		Subject: subject,
+		Email:   claimString(claims["email"]),
+		Name:    claimString(claims["name"]),
+	}
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified = verified == "true"
+	}
+	if identity.EmailVerified == false && p.config.TrustEmail && identity.Email != "" {
+		identity.EmailVerified = true
+	}
+	return identity, nil
+}
+
+// claimString renders string and numeric claims alike; GitHub, for one,
+// returns its user id as a JSON number.
+func claimString(value any) string {
+	switch typed := value.(type) {
+	case string:
+		return typed
+	case float64:
+		return fmt.Sprintf("%.0f", typed)
+	case json.Number:
+		return typed.String()
+	}
+	return ""
+}
+
+// OIDCState is kept in Redis between /start and /callback. Together with
+// the state cookie it binds the callback to the browser that started the
+// flow, and it carries the PKCE verifier, which never leaves the server.
+// LinkAccountUUID and LinkSessionID are set when a signed-in session started
+// the flow to link the provider instead of login.
+type OIDCState struct {
+	State           string                `json:"state"`
+	Provider        string                `json:"provider"`
+	CodeVerifier    string                `json:"codeVerifier"`
+	Nonce           string                `json:"nonce"`
+	DeviceInfo      commonuser.DeviceInfo `json:"deviceInfo"`
+	LinkAccountUUID string                `json:"linkAccountUUID,omitempty"`
+	LinkSessionID   string                `json:"linkSessionId,omitempty"`
+}
+
+func randomToken(size int) (string, error) {
+	buffer := make([]byte, size)
+	if _, errRead := rand.Read(buffer); errRead != nil {
+		return "", errRead
+	}
+	return base64.RawURLEncoding.EncodeToString(buffer), nil
+}
+
+func NewOIDCState(provider string, deviceInfo commonuser.DeviceInfo) (*OIDCState, error) {
+	state, errState := randomToken(32)
+	if errState != nil {
+		return nil, errState
+	}
+	verifier, errVerifier := randomToken(48)
+	if errVerifier != nil {
+		return nil, errVerifier
+	}
+	nonce, errNonce := randomToken(16)
+	if errNonce != nil {
+		return nil, errNonce
+	}
+
+	return &OIDCState{
+		State:        state,
+		Provider:     provider,
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		DeviceInfo:   deviceInfo,
+	}, nil
+}
+
+type OIDCStateStore struct {
+	redis redis.UniversalClient
+}
+
+func NewOIDCStateStore(redis redis.UniversalClient) *OIDCStateStore {
+	return &OIDCStateStore{redis: redis}
+}
+
+func (s *OIDCStateStore) Save(ctx context.Context, state *OIDCState) error {
+	payload, errMarshal := json.Marshal(state)
+	if errMarshal != nil {
+		return errMarshal
+	}
+	return s.redis.Set(ctx, "oidc-state:"+state.State, payload, OIDCStateLifespan).Err()
+}
+
+// Take returns the state and deletes it, so every state is single use.
+func (s *OIDCStateStore) Take(ctx context.Context, state string) (*OIDCState, error) {
+	payload, errGet := s.redis.GetDel(ctx, "oidc-state:"+state).Bytes()
+	if errors.Is(errGet, redis.Nil) {
+		return nil, OIDCStateNotFound
+	}
+	if errGet != nil {
+		return nil, errGet
+	}
+
+	var saved OIDCState
+	if errUnmarshal := json.Unmarshal(payload, &saved); errUnmarshal != nil {
+		return nil, errUnmarshal
+	}
+	return &saved, nil
+}
+
+// OIDCProviders is the registry behind the /auth/:provider routes.
+type OIDCProviders map[string]*OIDCProvider
+
+func NewOIDCProviders(configs []OIDCProviderConfig) OIDCProviders {
+	providers := make(OIDCProviders, len(configs))
+	for _, config := range configs {
+		providers[config.Name] = NewOIDCProvider(config)
+	}
+	return providers
+}
+
+func (p OIDCProviders) Get(name string) (*OIDCProvider, error) {
+	provider, found := p[name]
+	if !found {
+		return nil, OIDCProviderNotFound
+	}
+	return provider, nil
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/21strive/commonuser"
+	"github.com/21strive/commonuser/account"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type mockAuthorization struct {
+	challenge string
+	nonce     string
+}
+
+// mockIssuer is an OIDC provider that hands out one code per authorization
+// request and only redeems it once, for the PKCE verifier that matches the
+// challenge. nonceOverride, when set, replaces the nonce in the ID token.
+// While discoveryGate is non-nil, discovery waits for it to be closed.
+type mockIssuer struct {
+	*httptest.Server
+	key             *rsa.PrivateKey
+	mu              sync.Mutex
+	codes           map[string]mockAuthorization
+	nonceOverride   string
+	discoveryGate   chan struct{}
+	discoveryCounts atomic.Int32
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	issuer := &mockIssuer{key: newTestRSAKey(t), codes: map[string]mockAuthorization{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer.discoveryCounts.Add(1)
+		if issuer.discoveryGate != nil {
+			<-issuer.discoveryGate
+		}
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                issuer.URL,
+			AuthorizationEndpoint: issuer.URL + "/authorize",
+			TokenEndpoint:         issuer.URL + "/token",
+			JWKSURI:               issuer.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []jsonWebKey{rsaJWK("issuer-key", &issuer.key.PublicKey)}})
+	})
+	mux.HandleFunc("/token", issuer.token)
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+// authorize plays the user consenting at authorizationURL and returns the
+// code the provider would send back to the callback.
+func (m *mockIssuer) authorize(t *testing.T, authorizationURL string) string {
+	t.Helper()
+	parsed, errParse := url.Parse(authorizationURL)
+	if errParse != nil {
+		t.Fatal(errParse)
+	}
+	query := parsed.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("authorization URL without S256 PKCE: %s", authorizationURL)
+	}
+
+	code, errCode := randomToken(16)
+	if errCode != nil {
+		t.Fatal(errCode)
+	}
+	m.mu.Lock()
+	m.codes[code] = mockAuthorization{challenge: query.Get("code_challenge"), nonce: query.Get("nonce")}
+	m.mu.Unlock()
+	return code
+}
+
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	fail := func(code string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+
+	m.mu.Lock()
+	authorization, found := m.codes[r.FormValue("code")]
+	delete(m.codes, r.FormValue("code"))
+	m.mu.Unlock()
+	if !found {
+		fail("invalid_grant")
+		return
+	}
+
+	digest := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(digest[:]) != authorization.challenge {
+		fail("invalid_grant")
+		return
+	}
+
+	nonce := authorization.nonce
+	if m.nonceOverride != "" {
+		nonce = m.nonceOverride
+	}
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            m.URL,
+		"aud":            r.FormValue("client_id"),
+		"sub":            "mock-subject",
+		"email":          "ada@example.com",
+		"email_verified": true,
+		"nonce":          nonce,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+	})
+	idToken.Header["kid"] = "issuer-key"
+	signed, errSign := idToken.SignedString(m.key)
+	if errSign != nil {
+		http.Error(w, errSign.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "mock-access-token", "id_token": signed})
+}
+
+func mockProviderConfig(name string, issuer *mockIssuer) OIDCProviderConfig {
+	return OIDCProviderConfig{
+		Name:         name,
+		Issuer:       issuer.URL,
+		ClientID:     "mock-client",
+		ClientSecret: "mock-secret",
+		RedirectURL:  "https://app.example.com/auth/" + name + "/callback",
+		Scopes:       []string{"openid", "email"},
+		SubjectClaim: "sub",
+	}
+}
+
+func TestOIDCProviderExchange(t *testing.T) {
+	issuer := newMockIssuer(t)
+	oidcProvider := NewOIDCProvider(mockProviderConfig("mock", issuer))
+	ctx := context.Background()
+
+	state, errState := NewOIDCState("mock", commonuser.DeviceInfo{DeviceId: "d1"})
+	if errState != nil {
+		t.Fatal(errState)
+	}
+	authorizationURL, errURL := oidcProvider.AuthorizationURL(ctx, state)
+	if errURL != nil {
+		t.Fatal(errURL)
+	}
+	code := issuer.authorize(t, authorizationURL)
+
+	identity, errExchange := oidcProvider.Exchange(ctx, code, state)
+	if errExchange != nil {
+		t.Fatal(errExchange)
+	}
+	if identity.Issuer != "mock" || identity.Subject != "mock-subject" || identity.Email != "ada@example.com" || !identity.EmailVerified {
+		t.Fatalf("unexpected identity: %+v", identity)
+	}
+
+	if _, errReplay := oidcProvider.Exchange(ctx, code, state); !errors.Is(errReplay, OIDCExchangeFailed) {
+		t.Fatalf("replayed code: got %v, want OIDCExchangeFailed", errReplay)
+	}
+}
+
+func TestOIDCProviderRejectsWrongVerifier(t *testing.T) {
+	issuer := newMockIssuer(t)
+	oidcProvider := NewOIDCProvider(mockProviderConfig("mock", issuer))
+	ctx := context.Background()
+
+	state, _ := NewOIDCState("mock", commonuser.DeviceInfo{DeviceId: "d1"})
+	authorizationURL, errURL := oidcProvider.AuthorizationURL(ctx, state)
+	if errURL != nil {
+		t.Fatal(errURL)
+	}
+	code := issuer.authorize(t, authorizationURL)
+
+	// a code intercepted by an attacker is useless without the verifier
+	otherState, _ := NewOIDCState("mock", commonuser.DeviceInfo{DeviceId: "d1"})
+	if _, errExchange := oidcProvider.Exchange(ctx, code, otherState); !errors.Is(errExchange, OIDCExchangeFailed) {
+		t.Fatalf("got %v, want OIDCExchangeFailed", errExchange)
+	}
+}
+
+func TestOIDCProviderRejectsNonceMismatch(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.nonceOverride = "replayed-nonce"
+	oidcProvider := NewOIDCProvider(mockProviderConfig("mock", issuer))
+	ctx := context.Background()
+
+	state, _ := NewOIDCState("mock", commonuser.DeviceInfo{DeviceId: "d1"})
+	authorizationURL, errURL := oidcProvider.AuthorizationURL(ctx, state)
+	if errURL != nil {
+		t.Fatal(errURL)
+	}
+	code := issuer.authorize(t, authorizationURL)
+
+	if _, errExchange := oidcProvider.Exchange(ctx, code, state); !errors.Is(errExchange, InvalidIDToken) {
+		t.Fatalf("got %v, want InvalidIDToken", errExchange)
+	}
+}
+
+// oidcTestApp mounts the OIDC routes on a handler that has only what the
+// flow needs up to the code exchange.
+func oidcTestApp(t *testing.T, issuer *mockIssuer) *fiber.App {
+	handler := &HTTPHandler{
+		oidcProviders: NewOIDCProviders([]OIDCProviderConfig{
+			mockProviderConfig("mock", issuer),
+			mockProviderConfig("other", issuer),
+		}),
+		oidcStates: NewOIDCStateStore(newFakeRedis(t)),
+	}
+	app := fiber.New()
+	app.Get("/auth/:provider/start", handler.OIDCStart)
+	app.Get("/auth/:provider/callback", handler.OIDCCallback)
+	app.Post("/auth/:provider/callback", handler.OIDCCallback)
+	return app
+}
+
+type startedFlow struct {
+	authorizationURL string
+	state            string
+	cookie           *http.Cookie
+}
+
+func startOIDCTestFlow(t *testing.T, app *fiber.App, provider string) startedFlow {
+	t.Helper()
+	response, errStart := app.Test(httptest.NewRequest(http.MethodGet, "/auth/"+provider+"/start?deviceId=d1", nil), -1)
+	if errStart != nil {
+		t.Fatal(errStart)
+	}
+	if response.StatusCode != http.StatusFound {
+		t.Fatalf("start: status %d", response.StatusCode)
+	}
+
+	flow := startedFlow{authorizationURL: response.Header.Get("Location")}
+	parsed, errParse := url.Parse(flow.authorizationURL)
+	if errParse != nil {
+		t.Fatal(errParse)
+	}
+	flow.state = parsed.Query().Get("state")
+	for _, cookie := range response.Cookies() {
+		if cookie.Name == "oidcState" {
+			flow.cookie = cookie
+		}
+	}
+	if flow.cookie == nil || !flow.cookie.HttpOnly || flow.cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("start: missing HttpOnly SameSite=Lax state cookie: %v", response.Header["Set-Cookie"])
+	}
+	if strings.Contains(flow.cookie.Value, flow.state) {
+		t.Fatal("start: the cookie holds the state itself instead of its hash")
+	}
+	return flow
+}
+
+func callOIDCCallback(t *testing.T, app *fiber.App, provider string, query url.Values, cookie *http.Cookie) *http.Response {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodGet, "/auth/"+provider+"/callback?"+query.Encode(), nil)
+	if cookie != nil {
+		request.AddCookie(cookie)
+	}
+	response, errCall := app.Test(request, -1)
+	if errCall != nil {
+		t.Fatal(errCall)
+	}
+	return response
+}
+
+func TestOIDCCallbackNeedsTheStartingBrowser(t *testing.T) {
+	issuer := newMockIssuer(t)
+	app := oidcTestApp(t, issuer)
+
+	attackerFlow := startOIDCTestFlow(t, app, "mock")
+	code := issuer.authorize(t, attackerFlow.authorizationURL)
+	query := url.Values{"state": {attackerFlow.state}, "code": {code}}
+
+	// the victim's browser has no cookie, or the one of its own flow
+	victimFlow := startOIDCTestFlow(t, app, "mock")
+	for name, cookie := range map[string]*http.Cookie{"no cookie": nil, "other flow": victimFlow.cookie} {
+		if response := callOIDCCallback(t, app, "mock", query, cookie); response.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: status %d, want 400", name, response.StatusCode)
+		}
+	}
+}
+
+func TestOIDCCallbackStateIsSingleUse(t *testing.T) {
+	issuer := newMockIssuer(t)
+	app := oidcTestApp(t, issuer)
+
+	flow := startOIDCTestFlow(t, app, "mock")
+	query := url.Values{"state": {flow.state}, "code": {"not-issued"}}
+
+	// the issuer refuses the code, but the state is spent all the same
+	if response := callOIDCCallback(t, app, "mock", query, flow.cookie); response.StatusCode != http.StatusBadGateway {
+		t.Fatalf("first callback: status %d, want 502", response.StatusCode)
+	}
+	if response := callOIDCCallback(t, app, "mock", query, flow.cookie); response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("replayed callback: status %d, want 400", response.StatusCode)
+	}
+}
+
+func TestOIDCCallbackRejectsProviderMismatch(t *testing.T) {
+	issuer := newMockIssuer(t)
+	app := oidcTestApp(t, issuer)
+
+	flow := startOIDCTestFlow(t, app, "mock")
+	query := url.Values{"state": {flow.state}, "code": {issuer.authorize(t, flow.authorizationURL)}}
+
+	if response := callOIDCCallback(t, app, "other", query, flow.cookie); response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", response.StatusCode)
+	}
+}
+
+func TestProviderLinkNeedsTheStartingBrowser(t *testing.T) {
+	issuer := newMockIssuer(t)
+	handler := &HTTPHandler{
+		oidcProviders: NewOIDCProviders([]OIDCProviderConfig{mockProviderConfig("mock", issuer)}),
+		oidcStates:    NewOIDCStateStore(newFakeRedis(t)),
+	}
+	app := fiber.New()
+	app.Post("/auth/:provider/link", func(c *fiber.Ctx) error {
+		c.Locals("account", account.New())
+		c.Locals("sessionid", "attacker-session")
+		return c.Next()
+	}, handler.StartProviderLink)
+	app.Get("/auth/:provider/callback", handler.OIDCCallback)
+
+	response, errStart := app.Test(httptest.NewRequest(http.MethodPost, "/auth/mock/link", nil), -1)
+	if errStart != nil {
+		t.Fatal(errStart)
+	}
+	var started struct {
+		AuthorizationURL string `json:"authorizationURL"`
+	}
+	if errDecode := json.NewDecoder(response.Body).Decode(&started); errDecode != nil {
+		t.Fatal(errDecode)
+	}
+	parsed, errParse := url.Parse(started.AuthorizationURL)
+	if errParse != nil {
+		t.Fatal(errParse)
+	}
+
+	// the attacker hands the link URL to a victim, whose browser has no cookie
+	query := url.Values{"state": {parsed.Query().Get("state")}, "code": {issuer.authorize(t, started.AuthorizationURL)}}
+	if response := callOIDCCallback(t, app, "mock", query, nil); response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", response.StatusCode)
+	}
+}
+
+func TestOIDCProviderRejectsDiscoveryForAnotherIssuer(t *testing.T) {
+	issuer := newMockIssuer(t)
+	config := mockProviderConfig("mock", issuer)
+	// same document, but it names the issuer without the trailing slash
+	config.Issuer = issuer.URL + "/"
+	oidcProvider := NewOIDCProvider(config)
+
+	state, _ := NewOIDCState("mock", commonuser.DeviceInfo{DeviceId: "d1"})
+	if _, errURL := oidcProvider.AuthorizationURL(context.Background(), state); errURL == nil || !strings.Contains(errURL.Error(), "discovery document is for issuer") {
+		t.Fatalf("got %v, want an issuer mismatch", errURL)
+	}
+}
+
+func TestOIDCProviderDiscoveryDoesNotBlockOtherCallers(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.discoveryGate = make(chan struct{})
+	oidcProvider := NewOIDCProvider(mockProviderConfig("mock", issuer))
+	state, _ := NewOIDCState("mock", commonuser.DeviceInfo{DeviceId: "d1"})
+
+	first := make(chan error, 1)
+	go func() {
+		_, errURL := oidcProvider.AuthorizationURL(context.Background(), state)
+		first <- errURL
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// a caller that gives up is not stuck behind the hanging discovery
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	if _, errURL := oidcProvider.AuthorizationURL(ctx, state); !errors.Is(errURL, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want DeadlineExceeded", errURL)
+	}
+	if waited := time.Since(started); waited > time.Second {
+		t.Fatalf("gave up after %v", waited)
+	}
+
+	close(issuer.discoveryGate)
+	if errURL := <-first; errURL != nil {
+		t.Fatal(errURL)
+	}
+	if fetches := issuer.discoveryCounts.Load(); fetches != 1 {
+		t.Fatalf("discovery fetched %d times, want 1", fetches)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/matthewhartstonge/argon2"
+)
+
+const passwordHistorySchema = `
+CREATE TABLE IF NOT EXISTS password_history (
+	id           BIGSERIAL PRIMARY KEY,
+	account_uuid TEXT NOT NULL,
+	hash         TEXT NOT NULL,
+	created_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS password_history_account_idx ON password_history (account_uuid, id DESC);
+`
+
+// sqlExecutor is satisfied by both *sql.DB and *sql.Tx, so history writes
+// can join the transaction that changes the password.
+type sqlExecutor interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// PasswordHistory keeps argon2 hashes of the last size passwords of each
+// account, in a table owned by this service. A size of 0 disables it.
+type PasswordHistory struct {
+	size   int
+	hasher argon2.Config
+}
+
+func NewPasswordHistory(size int) *PasswordHistory {
+	return &PasswordHistory{
+		size:   size,
+		hasher: argon2.DefaultConfig(),
+	}
+}
+
+func (h *PasswordHistory) EnsureSchema(db *sql.DB) error {
+	if h.size == 0 {
+		return nil
+	}
+	_, errExec := db.Exec(passwordHistorySchema)
+	return errExec
+}
+
+// Contains reports whether password matches one of the account's last size
+// passwords.
+func (h *PasswordHistory) Contains(db sqlExecutor, accountUUID string, password string) (bool, error) {
+	if h.size == 0 {
+		return false, nil
+	}
+
+	rows, errQuery := db.Query(
+		`SELECT hash FROM password_history WHERE account_uuid = $1 ORDER BY id DESC LIMIT $2`,
+		accountUUID, h.size)
+	if errQuery != nil {
+		return false, errQuery
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash string
+		if errScan := rows.Scan(&hash); errScan != nil {
+			return false, errScan
+		}
+
+		matches, errVerify := argon2.VerifyEncoded([]byte(password), []byte(hash))
+		if errVerify != nil {
+			return false, errVerify
+		}
+		if matches {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// Enabled reports whether reuse is checked at all.
+func (h *PasswordHistory) Enabled() bool {
+	return h.size > 0
+}
+
+// Reused reports whether password is the account's current one, hashed as
+// currentHash, or one of its last size passwords. The current password is
+// compared directly since it may predate the history. With the history
+// disabled nothing counts as reused, the current password included.
+func (h *PasswordHistory) Reused(db sqlExecutor, accountUUID string, currentHash string, password string) (bool, error) {
+	if !h.Enabled() {
+		return false, nil
+	}
+	if currentHash != "" {
+		matches, errVerify := argon2.VerifyEncoded([]byte(password), []byte(currentHash))
+		if errVerify != nil {
+			return false, errVerify
+		}
+		if matches {
+			return true, nil
+		}
+	}
+	return h.Contains(db, accountUUID, password)
+}
+
+// Record adds password to the account's history and prunes the entries that
+// fell out of the last size.
+func (h *PasswordHistory) Record(db sqlExecutor, accountUUID string, password string) error {
+	if h.size == 0 {
+		return nil
+	}
+
+	hash, errHash := h.hasher.HashEncoded([]byte(password))
+	if errHash != nil {
+		return errHash
+	}
+
+	_, errInsert := db.Exec(
+		`INSERT INTO password_history (account_uuid, hash) VALUES ($1, $2)`,
+		accountUUID, string(hash))
+	if errInsert != nil {
+		return errInsert
+	}
+
+	_, errPrune := db.Exec(`
+		DELETE FROM password_history
+		WHERE account_uuid = $1 AND id NOT IN (
+			SELECT id FROM password_history WHERE account_uuid = $1 ORDER BY id DESC LIMIT $2
+		)`, accountUUID, h.size)
+	return errPrune
+}
+
+// ReuseError is the failed rule returned when a password is in the history.
+func (h *PasswordHistory) ReuseError(field string) ValidationErrors {
+	return ValidationErrors{{
+		Field:   field,
+		Rule:    "history",
+		Param:   fmt.Sprint(h.size),
+		Message: fmt.Sprintf("must differ from your last %d passwords", h.size),
+	}}
+}
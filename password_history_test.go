@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/matthewhartstonge/argon2"
+	"testing"
+)
+
+func TestPasswordHistoryReused(t *testing.T) {
+	hasher := argon2.DefaultConfig()
+	currentHash, errHash := hasher.HashEncoded([]byte("current-password"))
+	if errHash != nil {
+		t.Fatal(errHash)
+	}
+
+	cases := []struct {
+		name        string
+		size        int
+		currentHash string
+		password    string
+		want        bool
+	}{
+		{name: "disabled ignores the current password", size: 0, currentHash: string(currentHash), password: "current-password", want: false},
+		{name: "current password", size: 3, currentHash: string(currentHash), password: "current-password", want: true},
+		{name: "new password", size: 3, currentHash: string(currentHash), password: "another-password", want: false},
+		{name: "no current password", size: 3, currentHash: "", password: "current-password", want: false},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			history := NewPasswordHistory(testCase.size)
+			reused, errReused := history.Reused(newEmptyDB(t), "uuid", testCase.currentHash, testCase.password)
+			if errReused != nil {
+				t.Fatal(errReused)
+			}
+			if reused != testCase.want {
+				t.Fatalf("reused %v, want %v", reused, testCase.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	PasswordClassLower  = "lower"
+	PasswordClassUpper  = "upper"
+	PasswordClassDigit  = "digit"
+	PasswordClassSymbol = "symbol"
+)
+
+var passwordClasses = []string{PasswordClassLower, PasswordClassUpper, PasswordClassDigit, PasswordClassSymbol}
+
+var passwordClassNames = map[string]string{
+	PasswordClassLower:  "lowercase letter",
+	PasswordClassUpper:  "uppercase letter",
+	PasswordClassDigit:  "digit",
+	PasswordClassSymbol: "symbol",
+}
+
+// commonPasswords is a short list of the most used passwords. A password
+// that is one of them, give or take case and a digit or symbol suffix,
+// scores 0 whatever its length.
+var commonPasswords = map[string]struct{}{}
+
+func init() {
+	for _, password := range strings.Fields(`
+		password passw0rd p@ssword qwerty qwertyuiop asdfgh asdfghjkl zxcvbnm
+		abc123 abcdef letmein welcome welcome1 admin administrator root toor
+		iloveyou monkey dragon master sunshine princess football baseball
+		superman batman trustno1 shadow michael jennifer jordan hunter
+		starwars whatever freedom secret changeme default login access
+		hello charlie donald mustang computer internet summer winter
+		111111 123123 123456 1234567 12345678 123456789 1234567890
+		000000 654321 666666 696969 121212 112233 987654321`) {
+		commonPasswords[password] = struct{}{}
+	}
+}
+
+var keyboardRows = []string{
+	"abcdefghijklmnopqrstuvwxyz", "0123456789",
+	"qwertyuiop", "asdfghjkl", "zxcvbnm",
+}
+
+// PasswordPolicy checks new passwords. Every rule that fails is reported,
+// named so clients can explain it: min-length, max-length, class (with the
+// missing class as param), personal-info, strength (with the score) and
+// breached. breached may be nil when no breach corpus is configured.
+type PasswordPolicy struct {
+	config   PasswordConfig
+	breached *BreachedPasswords
+}
+
+func NewPasswordPolicy(config PasswordConfig, breached *BreachedPasswords) *PasswordPolicy {
+	return &PasswordPolicy{config: config, breached: breached}
+}
+
+// Check validates password, reported under field. personal holds the
+// username, email and the like, which the password must not contain.
+func (p *PasswordPolicy) Check(field string, password string, personal ...string) error {
+	var failures ValidationErrors
+	fail := func(rule string, param string, message string) {
+		failures = append(failures, FieldError{Field: field, Rule: rule, Param: param, Message: message})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < p.config.MinLength {
+		fail("min-length", fmt.Sprint(p.config.MinLength), fmt.Sprintf("must be at least %d characters", p.config.MinLength))
+	}
+	if length > p.config.MaxLength {
+		fail("max-length", fmt.Sprint(p.config.MaxLength), fmt.Sprintf("must be at most %d characters", p.config.MaxLength))
+	}
+
+	present := passwordClassesOf(password)
+	for _, class := range p.config.RequiredClasses {
+		if !present[class] {
+			fail("class", class, "must contain at least one "+passwordClassNames[class])
+		}
+	}
+
+	if p.config.ForbidPersonalInfo {
+		lowered := strings.ToLower(password)
+		for _, value := range personalFragments(personal) {
+			if strings.Contains(lowered, value) {
+				fail("personal-info", "", "must not contain your name, username or email")
+				break
+			}
+		}
+	}
+
+	if score := PasswordScore(password); score < p.config.MinScore {
+		fail("strength", fmt.Sprint(score), fmt.Sprintf("is too easy to guess (strength %d of 4, %d required)", score, p.config.MinScore))
+	}
+
+	if p.breached != nil && p.breached.Contains(password) {
+		fail("breached", "", "appears in a known data breach, choose another one")
+	}
+
+	if len(failures) > 0 {
+		return failures
+	}
+	return nil
+}
+
+func passwordClassesOf(password string) map[string]bool {
+	present := map[string]bool{}
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			present[PasswordClassLower] = true
+		case unicode.IsUpper(r):
+			present[PasswordClassUpper] = true
+		case unicode.IsDigit(r):
+			present[PasswordClassDigit] = true
+		default:
+			present[PasswordClassSymbol] = true
+		}
+	}
+	return present
+}
+
+// personalFragments lowers the personal values and splits emails into the
+// local part and the domain name; fragments under 3 characters are ignored.
+func personalFragments(personal []string) []string {
+	var fragments []string
+	for _, value := range personal {
+		value = strings.ToLower(strings.TrimSpace(value))
+		candidates := []string{value}
+		if local, domain, isEmail := strings.Cut(value, "@"); isEmail {
+			domainName, _, _ := strings.Cut(domain, ".")
+			candidates = []string{local, domainName}
+		}
+		for _, candidate := range candidates {
+			if utf8.RuneCountInString(candidate) >= 3 {
+				fragments = append(fragments, candidate)
+			}
+		}
+	}
+	return fragments
+}
+
+// PasswordScore estimates how hard password is to guess on zxcvbn's 0-4
+// scale. It is a much simpler model: brute-force entropy over the character
+// pool in use, where repeated characters and keyboard or alphabet runs add
+// nothing, and common passwords score 0.
+func PasswordScore(password string) int {
+	lowered := strings.ToLower(password)
+	if _, common := commonPasswords[strings.TrimRightFunc(lowered, isPasswordSuffix)]; common {
+		return 0
+	}
+	if _, common := commonPasswords[lowered]; common {
+		return 0
+	}
+
+	pool := 0
+	present := passwordClassesOf(password)
+	if present[PasswordClassLower] {
+		pool += 26
+	}
+	if present[PasswordClassUpper] {
+		pool += 26
+	}
+	if present[PasswordClassDigit] {
+		pool += 10
+	}
+	if present[PasswordClassSymbol] {
+		pool += 33
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	runes := []rune(lowered)
+	effective := 0
+	for i, r := range runes {
+		if i > 0 && (r == runes[i-1] || isRun(runes[i-1], r)) {
+			continue
+		}
+		effective++
+	}
+
+	bits := float64(effective) * math.Log2(float64(pool))
+	switch {
+	case bits < 25:
+		return 0
+	case bits < 35:
+		return 1
+	case bits < 50:
+		return 2
+	case bits < 65:
+		return 3
+	}
+	return 4
+}
+
+func isPasswordSuffix(r rune) bool {
+	return unicode.IsDigit(r) || unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
+
+// isRun reports whether next follows previous on one of keyboardRows, in
+// either direction.
+func isRun(previous rune, next rune) bool {
+	for _, row := range keyboardRows {
+		at := strings.IndexRune(row, previous)
+		if at == -1 {
+			continue
+		}
+		if (at+1 < len(row) && rune(row[at+1]) == next) || (at > 0 && rune(row[at-1]) == next) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPasswordScore(t *testing.T) {
+	cases := []struct {
+		password string
+		want     int
+	}{
+		{password: "", want: 0},
+		{password: "password", want: 0},
+		{password: "Password2024!", want: 0},
+		{password: "aaaaaaaaaaaaaaaa", want: 0},
+		{password: "abcdefghijklmnop", want: 0},
+		{password: "qwertyuiopasdfgh", want: 0},
+		{password: "blue7h", want: 1},
+		{password: "mountain", want: 2},
+		{password: "Blue7horse", want: 3},
+		{password: "Blue7horse!river", want: 4},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.password, func(t *testing.T) {
+			if got := PasswordScore(testCase.password); got != testCase.want {
+				t.Fatalf("PasswordScore = %d, want %d", got, testCase.want)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	breachFilter := NewBloomFilter(1, 0.0001)
+	breachFilter.Add(sha1.Sum([]byte("Blue7horse!river")))
+	policy := NewPasswordPolicy(PasswordConfig{
+		MinLength:          8,
+		MaxLength:          20,
+		RequiredClasses:    []string{PasswordClassUpper, PasswordClassDigit},
+		MinScore:           3,
+		ForbidPersonalInfo: true,
+	}, &BreachedPasswords{filter: breachFilter})
+
+	type failure struct{ rule, param string }
+	cases := []struct {
+		name     string
+		password string
+		personal []string
+		want     []failure
+	}{
+		{name: "strong", password: "Green4lake&stone", personal: []string{"budi", "budi@example.com"}},
+		{name: "too short", password: "Bl7h!x", want: []failure{{"min-length", "8"}, {"strength", "2"}}},
+		{name: "too long", password: "Green4lake&stone#river", want: []failure{{"max-length", "20"}}},
+		{name: "missing classes", password: "green!lake&stone", want: []failure{{"class", PasswordClassUpper}, {"class", PasswordClassDigit}}},
+		{name: "username", password: "Budi4lake&stone", personal: []string{"budi"}, want: []failure{{"personal-info", ""}}},
+		{name: "email domain", password: "Green4lake&acme", personal: []string{"someone@acme.io"}, want: []failure{{"personal-info", ""}}},
+		{name: "short fragments ignored", password: "Green4lake&stone", personal: []string{"al", "on@x.io"}},
+		{name: "weak", password: "Password2024!", want: []failure{{"strength", "0"}}},
+		{name: "breached", password: "Blue7horse!river", want: []failure{{"breached", ""}}},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			errCheck := policy.Check("password", testCase.password, testCase.personal...)
+			if len(testCase.want) == 0 {
+				if errCheck != nil {
+					t.Fatalf("unexpected failure: %v", errCheck)
+				}
+				return
+			}
+
+			var failures ValidationErrors
+			if !errors.As(errCheck, &failures) {
+				t.Fatalf("error %v, want ValidationErrors", errCheck)
+			}
+			var got []failure
+			for _, fieldError := range failures {
+				if fieldError.Field != "password" {
+					t.Errorf("failure reported under %q", fieldError.Field)
+				}
+				got = append(got, failure{fieldError.Rule, fieldError.Param})
+			}
+			if !reflect.DeepEqual(got, testCase.want) {
+				t.Fatalf("failures %v, want %v", got, testCase.want)
+			}
+		})
+	}
+}
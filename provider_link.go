@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/21strive/commonuser"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+const (
+	ProviderLinkAutoVerifiedEmail = "verified-email"
+	ProviderLinkPassword          = "password"
+	PendingProviderLinkLifespan   = 10 * time.Minute
+)
+
+var (
+	PendingLinkNotFound   = errors.New("pending provider link unknown or expired")
+	ProviderLinkedToOther = errors.New("provider identity is linked to another account")
+	LastLoginMethod       = errors.New("cannot unlink the last login method of an account without password")
+	PasswordAlreadySet    = errors.New("account already has a password")
+)
+
+// PendingProviderLink is a provider identity whose email belongs to an
+// existing account. It is linked once the account owner confirms with their
+// password, within PendingProviderLinkLifespan.
+type PendingProviderLink struct {
+	AccountUUID string                `json:"accountUUID"`
+	Identity    ProviderIdentity      `json:"identity"`
+	DeviceInfo  commonuser.DeviceInfo `json:"deviceInfo"`
+}
+
+// PendingLinkStore keeps pending links in Redis under the hash of their
+// token, like RefreshTokenStore does for refresh tokens.
+type PendingLinkStore struct {
+	redis redis.UniversalClient
+}
+
+func NewPendingLinkStore(redis redis.UniversalClient) *PendingLinkStore {
+	return &PendingLinkStore{redis: redis}
+}
+
+func pendingLinkKey(linkToken string) string {
+	return "provider-link:" + hashRefreshToken(linkToken)
+}
+
+// Save stores the pending link and returns the token handed to the client.
+func (s *PendingLinkStore) Save(ctx context.Context, link PendingProviderLink) (string, error) {
+	linkToken, errToken := randomToken(32)
+	if errToken != nil {
+		return "", errToken
+	}
+
+	payload, errMarshal := json.Marshal(link)
+	if errMarshal != nil {
+		return "", errMarshal
+	}
+
+	errSet := s.redis.Set(ctx, pendingLinkKey(linkToken), payload, PendingProviderLinkLifespan).Err()
+	if errSet != nil {
+		return "", errSet
+	}
+	return linkToken, nil
+}
+
+// Take returns the pending link and deletes it: a wrong password spends the
+// token, so it cannot be used to guess the password.
+func (s *PendingLinkStore) Take(ctx context.Context, linkToken string) (*PendingProviderLink, error) {
+	payload, errGet := s.redis.GetDel(ctx, pendingLinkKey(linkToken)).Bytes()
+	if errors.Is(errGet, redis.Nil) {
+		return nil, PendingLinkNotFound
+	}
+	if errGet != nil {
+		return nil, errGet
+	}
+
+	var link PendingProviderLink
+	if errUnmarshal := json.Unmarshal(payload, &link); errUnmarshal != nil {
+		return nil, errUnmarshal
+	}
+	return &link, nil
+}
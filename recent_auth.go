@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+const RecentProviderAuthWindow = 10 * time.Minute
+
+// RecentAuthStore remembers which sessions were opened through an identity
+// provider in the last RecentProviderAuthWindow. Such a fresh provider login
+// stands in for the password on sensitive actions of provider-only accounts.
+type RecentAuthStore struct {
+	redis redis.UniversalClient
+}
+
+func NewRecentAuthStore(redis redis.UniversalClient) *RecentAuthStore {
+	return &RecentAuthStore{redis: redis}
+}
+
+func recentAuthKey(sessionId string) string {
+	return "recent-provider-auth:" + sessionId
+}
+
+func (s *RecentAuthStore) Mark(ctx context.Context, sessionId string) error {
+	return s.redis.Set(ctx, recentAuthKey(sessionId), time.Now().Unix(), RecentProviderAuthWindow).Err()
+}
+
+// Has reports whether the session has a recent provider login, without
+// spending it.
+func (s *RecentAuthStore) Has(ctx context.Context, sessionId string) (bool, error) {
+	found, errExists := s.redis.Exists(ctx, recentAuthKey(sessionId)).Result()
+	if errExists != nil {
+		return false, errExists
+	}
+	return found > 0, nil
+}
+
+// Consume reports whether the session has a recent provider login and spends
+// it, so one login authorizes one sensitive action.
+func (s *RecentAuthStore) Consume(ctx context.Context, sessionId string) (bool, error) {
+	deleted, errDel := s.redis.Del(ctx, recentAuthKey(sessionId)).Result()
+	if errDel != nil {
+		return false, errDel
+	}
+	return deleted > 0, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRecentAuthHasDoesNotSpend(t *testing.T) {
+	store := NewRecentAuthStore(newFakeRedis(t))
+	ctx := context.Background()
+
+	if errMark := store.Mark(ctx, "s1"); errMark != nil {
+		t.Fatal(errMark)
+	}
+	for i := 0; i < 2; i++ {
+		if found, errHas := store.Has(ctx, "s1"); errHas != nil || !found {
+			t.Fatalf("Has #%d: %v, %v", i+1, found, errHas)
+		}
+	}
+
+	if consumed, errConsume := store.Consume(ctx, "s1"); errConsume != nil || !consumed {
+		t.Fatalf("Consume: %v, %v", consumed, errConsume)
+	}
+	if consumed, _ := store.Consume(ctx, "s1"); consumed {
+		t.Fatal("a recent login was consumed twice")
+	}
+	if found, _ := store.Has(ctx, "s1"); found {
+		t.Fatal("Has after Consume")
+	}
+}
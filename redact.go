@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+const RedactedValue = "[REDACTED]"
+
+// DefaultRedactedFields are always masked in logged request bodies, on top of
+// any field tagged `redact:"true"` in request.go and any configured extras.
+var DefaultRedactedFields = []string{
+	"password", "oldPassword", "newPassword", "token", "revokeToken",
+	"verificationCode", "accessToken", "refreshToken", "idToken", "linkToken",
+}
+
+// Redactor masks the values of denylisted JSON keys, at any depth, before a
+// request body is written to the logs. Key matching is case-insensitive.
+type Redactor struct {
+	mu     sync.RWMutex
+	fields map[string]struct{}
+}
+
+func NewRedactor(fields ...string) *Redactor {
+	redactor := &Redactor{fields: map[string]struct{}{}}
+	redactor.AddFields(fields...)
+	return redactor
+}
+
+func (r *Redactor) AddFields(fields ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field != "" {
+			r.fields[strings.ToLower(field)] = struct{}{}
+		}
+	}
+}
+
+// AddTaggedFields registers the JSON name of every field tagged
+// `redact:"true"` on the given struct values, including embedded structs.
+func (r *Redactor) AddTaggedFields(payloads ...any) {
+	for _, payload := range payloads {
+		r.AddFields(taggedFields(reflect.TypeOf(payload))...)
+	}
+}
+
+func taggedFields(t reflect.Type) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var fields []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			fields = append(fields, taggedFields(field.Type)...)
+			continue
+		}
+		if field.Tag.Get("redact") != "true" {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, name)
+	}
+	return fields
+}
+
+func (r *Redactor) redacts(key string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, found := r.fields[strings.ToLower(key)]
+	return found
+}
+
+// Redact returns a compact copy of body with denylisted values masked. A body
+// that is not valid JSON is never logged verbatim.
+func (r *Redactor) Redact(body []byte) json.RawMessage {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var parsed any
+	if err := decoder.Decode(&parsed); err != nil {
+		return json.RawMessage(`"[unparseable body]"`)
+	}
+
+	redacted, err := json.Marshal(r.redactValue(parsed))
+	if err != nil {
+		return json.RawMessage(`"[unparseable body]"`)
+	}
+	return redacted
+}
+
+func (r *Redactor) redactValue(value any) any {
+	switch typed := value.(type) {
+	case map[string]any:
+		for key, nested := range typed {
+			if r.redacts(key) {
+				typed[key] = RedactedValue
+			} else {
+				typed[key] = r.redactValue(nested)
+			}
+		}
+	case []any:
+		for i, nested := range typed {
+			typed[i] = r.redactValue(nested)
+		}
+	}
+	return value
+}
+
+var LogRedactor = newLogRedactor()
+
+func newLogRedactor() *Redactor {
+	redactor := NewRedactor(DefaultRedactedFields...)
+	redactor.AddTaggedFields(
+		NativeRegister{}, VerifyRegistration{}, LoginWithEmail{}, LoginWithUsername{},
+		AuthWithGoogle{}, LinkWithGoogle{}, ConfirmProviderLink{}, UpdateAccount{}, UpdateEmail{}, ValidateUpdateEmail{},
+		RevokeUpdateEmail{}, UpdatePassword{}, SetInitialPassword{}, ForgotPassword{}, ResetPassword{},
+	)
+	return redactor
+}
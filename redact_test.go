@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+type redactTestAudit struct {
+	Pin string `json:"pin" redact:"true"`
+}
+
+type redactTestPayload struct {
+	Login  string `json:"login"`
+	Secret string `json:"secret,omitempty" redact:"true"`
+	redactTestAudit
+}
+
+func TestRedactorRedact(t *testing.T) {
+	redactor := NewRedactor("password", " apiKey ", "")
+	redactor.AddTaggedFields(&redactTestPayload{})
+
+	cases := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "top level", body: `{"login":"budi","password":"hunter2"}`, want: `{"login":"budi","password":"[REDACTED]"}`},
+		{name: "case-insensitive", body: `{"PASSWORD":"hunter2","ApiKey":"k"}`, want: `{"ApiKey":"[REDACTED]","PASSWORD":"[REDACTED]"}`},
+		{name: "nested object", body: `{"account":{"login":"budi","credentials":{"password":"hunter2"}}}`, want: `{"account":{"credentials":{"password":"[REDACTED]"},"login":"budi"}}`},
+		{name: "array of objects", body: `{"keys":[{"apiKey":"a","name":"ci"},{"apiKey":"b"}]}`, want: `{"keys":[{"apiKey":"[REDACTED]","name":"ci"},{"apiKey":"[REDACTED]"}]}`},
+		{name: "top level array", body: `[{"password":"a"},[{"password":"b"}],"password"]`, want: `[{"password":"[REDACTED]"},[{"password":"[REDACTED]"}],"password"]`},
+		{name: "redacted object value", body: `{"password":{"old":"a","new":"b"}}`, want: `{"password":"[REDACTED]"}`},
+		{name: "tagged and embedded fields", body: `{"login":"budi","secret":"s","pin":1234}`, want: `{"login":"budi","pin":"[REDACTED]","secret":"[REDACTED]"}`},
+		{name: "numbers keep their precision", body: `{"id":12345678901234567890}`, want: `{"id":12345678901234567890}`},
+		{name: "not json", body: `password=hunter2`, want: `"[unparseable body]"`},
+		{name: "empty", body: ``, want: `"[unparseable body]"`},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if got := string(redactor.Redact([]byte(testCase.body))); got != testCase.want {
+				t.Fatalf("Redact = %s, want %s", got, testCase.want)
+			}
+		})
+	}
+}
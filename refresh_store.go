@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/21strive/item"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+var (
+	RefreshTokenNotFound = errors.New("refresh token not found")
+	RefreshTokenReused   = errors.New("refresh token already rotated")
+)
+
+// RefreshBinding is what a refresh token resolves to, so /refresh can work
+// from the cookie alone without an access token. Every token rotated out of
+// the same login shares one Family.
+type RefreshBinding struct {
+	AccountUUID string `json:"accountUUID"`
+	SessionID   string `json:"sessionId"`
+	Family      string `json:"family"`
+}
+
+// RefreshTokenStore indexes refresh tokens in Redis by their SHA-256 hash;
+// the raw token is never stored. Rotated tokens are remembered for one
+// lifespan so that replaying one can be told apart from an unknown token.
+type RefreshTokenStore struct {
+	redis    redis.UniversalClient
+	lifespan time.Duration
+}
+
+func NewRefreshTokenStore(redis redis.UniversalClient, lifespan time.Duration) *RefreshTokenStore {
+	return &RefreshTokenStore{
+		redis:    redis,
+		lifespan: lifespan,
+	}
+}
+
+func hashRefreshToken(refreshToken string) string {
+	digest := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(digest[:])
+}
+
+func activeRefreshKey(tokenHash string) string {
+	return "refresh:" + tokenHash
+}
+
+func rotatedRefreshKey(tokenHash string) string {
+	return "refresh-rotated:" + tokenHash
+}
+
+func refreshFamilyKey(family string) string {
+	return "refresh-family:" + family
+}
+
+// Bind makes refreshToken the current token of binding.Family, starting a
+// new family when none is set. It returns the binding as stored.
+func (s *RefreshTokenStore) Bind(ctx context.Context, refreshToken string, binding RefreshBinding) (RefreshBinding, error) {
+	if binding.Family == "" {
+		binding.Family = item.RandId()
+	}
+
+	payload, errMarshal := json.Marshal(binding)
+	if errMarshal != nil {
+		return binding, errMarshal
+	}
+
+	tokenHash := hashRefreshToken(refreshToken)
+	_, errPipe := s.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, activeRefreshKey(tokenHash), payload, s.lifespan)
+		pipe.Set(ctx, refreshFamilyKey(binding.Family), tokenHash, s.lifespan)
+		return nil
+	})
+	return binding, errPipe
+}
+
+// Resolve returns the binding of a current token. For a token that was
+// already rotated it returns the binding together with RefreshTokenReused.
+func (s *RefreshTokenStore) Resolve(ctx context.Context, refreshToken string) (*RefreshBinding, error) {
+	tokenHash := hashRefreshToken(refreshToken)
+
+	payload, errGet := s.redis.Get(ctx, activeRefreshKey(tokenHash)).Bytes()
+	if errors.Is(errGet, redis.Nil) {
+		payload, errGet = s.redis.Get(ctx, rotatedRefreshKey(tokenHash)).Bytes()
+		if errors.Is(errGet, redis.Nil) {
+			return nil, RefreshTokenNotFound
+		}
+		if errGet != nil {
+			return nil, errGet
+		}
+
+		var binding RefreshBinding
+		if errUnmarshal := json.Unmarshal(payload, &binding); errUnmarshal != nil {
+			return nil, errUnmarshal
+		}
+		return &binding, RefreshTokenReused
+	}
+	if errGet != nil {
+		return nil, errGet
+	}
+
+	var binding RefreshBinding
+	if errUnmarshal := json.Unmarshal(payload, &binding); errUnmarshal != nil {
+		return nil, errUnmarshal
+	}
+	return &binding, nil
+}
+
+// Retire moves a token that has just been rotated into the rotated set. The
+// token is taken out of the active set atomically, so of two requests
+// rotating the same token only one retires it; the other gets
+// RefreshTokenReused.
+func (s *RefreshTokenStore) Retire(ctx context.Context, refreshToken string, binding RefreshBinding) error {
+	payload, errMarshal := json.Marshal(binding)
+	if errMarshal != nil {
+		return errMarshal
+	}
+
+	tokenHash := hashRefreshToken(refreshToken)
+	errTake := s.redis.GetDel(ctx, activeRefreshKey(tokenHash)).Err()
+	if errors.Is(errTake, redis.Nil) {
+		return RefreshTokenReused
+	}
+	if errTake != nil {
+		return errTake
+	}
+	return s.redis.Set(ctx, rotatedRefreshKey(tokenHash), payload, s.lifespan).Err()
+}
+
+// RevokeFamily invalidates the current token of a family, so neither the
+// attacker nor the victim can keep refreshing after a replay.
+func (s *RefreshTokenStore) RevokeFamily(ctx context.Context, family string) error {
+	currentHash, errGet := s.redis.Get(ctx, refreshFamilyKey(family)).Result()
+	if errors.Is(errGet, redis.Nil) {
+		return nil
+	}
+	if errGet != nil {
+		return errGet
+	}
+
+	_, errPipe := s.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, activeRefreshKey(currentHash))
+		pipe.Del(ctx, refreshFamilyKey(family))
+		return nil
+	})
+	return errPipe
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRefreshTokenStoreRetireOnlyOnce(t *testing.T) {
+	store := NewRefreshTokenStore(newFakeRedis(t), time.Hour)
+	ctx := context.Background()
+
+	binding, errBind := store.Bind(ctx, "token-1", RefreshBinding{AccountUUID: "a1", SessionID: "s1"})
+	if errBind != nil {
+		t.Fatal(errBind)
+	}
+	if errRetire := store.Retire(ctx, "token-1", binding); errRetire != nil {
+		t.Fatal(errRetire)
+	}
+	// a second request rotating the same token concurrently loses
+	if errRetire := store.Retire(ctx, "token-1", binding); !errors.Is(errRetire, RefreshTokenReused) {
+		t.Fatalf("got %v, want RefreshTokenReused", errRetire)
+	}
+}
+
+func TestRefreshTokenStoreFamilyReuse(t *testing.T) {
+	store := NewRefreshTokenStore(newFakeRedis(t), time.Hour)
+	ctx := context.Background()
+
+	// token-1 is rotated to token-2; token-3 belongs to another login
+	first, errBind := store.Bind(ctx, "token-1", RefreshBinding{AccountUUID: "a1", SessionID: "s1"})
+	if errBind != nil {
+		t.Fatal(errBind)
+	}
+	if errRetire := store.Retire(ctx, "token-1", first); errRetire != nil {
+		t.Fatal(errRetire)
+	}
+	second, errBind := store.Bind(ctx, "token-2", first)
+	if errBind != nil {
+		t.Fatal(errBind)
+	}
+	other, errBind := store.Bind(ctx, "token-3", RefreshBinding{AccountUUID: "a1", SessionID: "s2"})
+	if errBind != nil {
+		t.Fatal(errBind)
+	}
+	if second.Family != first.Family || other.Family == first.Family {
+		t.Fatalf("families %q, %q and %q: rotation must keep the family, a new login must not", first.Family, second.Family, other.Family)
+	}
+
+	resolve := []struct {
+		token      string
+		wantFamily string
+		wantErr    error
+	}{
+		{token: "token-1", wantFamily: first.Family, wantErr: RefreshTokenReused},
+		{token: "token-2", wantFamily: first.Family},
+		{token: "token-3", wantFamily: other.Family},
+		{token: "token-unknown", wantErr: RefreshTokenNotFound},
+	}
+	for _, testCase := range resolve {
+		binding, errResolve := store.Resolve(ctx, testCase.token)
+		if !errors.Is(errResolve, testCase.wantErr) {
+			t.Fatalf("%s: got %v, want %v", testCase.token, errResolve, testCase.wantErr)
+		}
+		if testCase.wantFamily != "" && (binding == nil || binding.Family != testCase.wantFamily || binding.SessionID == "") {
+			t.Fatalf("%s: resolved to %+v, want family %q", testCase.token, binding, testCase.wantFamily)
+		}
+	}
+
+	// the replay of token-1 revokes the family: token-2 stops working too
+	if errRevoke := store.RevokeFamily(ctx, first.Family); errRevoke != nil {
+		t.Fatal(errRevoke)
+	}
+	revoked := []struct {
+		token   string
+		wantErr error
+	}{
+		{token: "token-1", wantErr: RefreshTokenReused},
+		{token: "token-2", wantErr: RefreshTokenNotFound},
+		{token: "token-3", wantErr: nil},
+	}
+	for _, testCase := range revoked {
+		if _, errResolve := store.Resolve(ctx, testCase.token); !errors.Is(errResolve, testCase.wantErr) {
+			t.Fatalf("%s after revoke: got %v, want %v", testCase.token, errResolve, testCase.wantErr)
+		}
+	}
+
+	if errRevoke := store.RevokeFamily(ctx, first.Family); errRevoke != nil {
+		t.Fatalf("revoking twice: %v", errRevoke)
+	}
+}
@@ -3,67 +3,81 @@ package main
 import "github.com/21strive/commonuser"
 
 type NativeRegister struct {
-	Name     string `json:"name"`
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
-	Avatar   string `json:"avatar"`
+	Name     string `json:"name" binding:"required,max=100"`
+	Username string `json:"username" binding:"required,username,min=3,max=30"`
+	Email    string `json:"email" binding:"required,email,max=254"`
+	Password string `json:"password" redact:"true" binding:"required"`
+	Avatar   string `json:"avatar" binding:"url,max=2048"`
+	Locale   string `json:"locale" binding:"locale"`
 	commonuser.DeviceInfo
 }
 type VerifyRegistration struct {
-	VerificationCode string `json:"verificationCode"`
+	VerificationCode string `json:"verificationCode" redact:"true" binding:"required,max=64"`
 }
 
 type LoginWithEmail struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email    string `json:"email" binding:"required,email,max=254"`
+	Password string `json:"password" redact:"true" binding:"required,max=255"`
 	commonuser.DeviceInfo
 }
 
 type LoginWithUsername struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username string `json:"username" binding:"required,max=30"`
+	Password string `json:"password" redact:"true" binding:"required,max=255"`
 	commonuser.DeviceInfo
 }
 
 type AuthWithGoogle struct {
-	Sub   string `json:"sub"`
-	Email string `json:"email"`
-	Name  string `json:"name"`
+	IDToken string `json:"idToken" redact:"true" binding:"required,max=8192"`
 	commonuser.DeviceInfo
 }
 
+type LinkWithGoogle struct {
+	IDToken string `json:"idToken" redact:"true" binding:"required,max=8192"`
+}
+
+type ConfirmProviderLink struct {
+	LinkToken string `json:"linkToken" redact:"true" binding:"required,max=128"`
+	Password  string `json:"password" redact:"true" binding:"required,max=255"`
+}
+
 type UpdateAccount struct {
-	Name     string `json:"name"`
-	Username string `json:"username"`
-	Avatar   string `json:"avatar"`
+	Name     string `json:"name" binding:"max=100"`
+	Username string `json:"username" binding:"username,min=3,max=30"`
+	Avatar   string `json:"avatar" binding:"url,max=2048"`
+	Locale   string `json:"locale" binding:"locale"`
 }
 
 type UpdateEmail struct {
-	NewEmail string `json:"newEmail"`
+	NewEmail string `json:"newEmail" binding:"required,email,max=254"`
 }
 
 type ValidateUpdateEmail struct {
-	AccountUUID string `json:"accountUUID"`
-	Token       string `json:"token"`
+	AccountUUID string `json:"accountUUID" binding:"required,max=64"`
+	Token       string `json:"token" redact:"true" binding:"required,max=255"`
 }
 
 type RevokeUpdateEmail struct {
-	AccountUUID string `json:"accountUUID"`
-	RevokeToken string `json:"revokeToken"`
+	AccountUUID string `json:"accountUUID" binding:"required,max=64"`
+	RevokeToken string `json:"revokeToken" redact:"true" binding:"required,max=255"`
 }
 
 type UpdatePassword struct {
-	OldPassword string `json:"oldPassword"`
-	NewPassword string `json:"newPassword"`
+	OldPassword string `json:"oldPassword" redact:"true" binding:"required,max=255"`
+	NewPassword string `json:"newPassword" redact:"true" binding:"required"`
+}
+
+type SetInitialPassword struct {
+	Token       string `json:"token" redact:"true" binding:"max=255"`
+	NewPassword string `json:"newPassword" redact:"true" binding:"required"`
 }
 
 type ForgotPassword struct {
-	Email string `json:"email"`
+	Email string `json:"email" binding:"required,email,max=254"`
 }
 
 type ResetPassword struct {
-	AccountUUID string `json:"accountUUID"`
-	Token       string `json:"token"`
-	NewPassword string `json:"newPassword" binding:"required,min=8,max=255"`
+	AccountUUID string `json:"accountUUID" binding:"required,max=64"`
+	Token       string `json:"token" redact:"true" binding:"required,max=255"`
+	NewPassword string `json:"newPassword" redact:"true" binding:"required"`
 }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/redis/go-redis/v9"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const SessionInvalidationChannel = "commonuser:session-invalidate"
+
+type sessionCacheEntry struct {
+	accountUUID string
+	expiresAt   time.Time
+}
+
+// sessionInvalidation is published on SessionInvalidationChannel. Exactly one
+// of the fields is meaningful.
+type sessionInvalidation struct {
+	SessionID   string `json:"sessionId,omitempty"`
+	AccountUUID string `json:"accountUUID,omitempty"`
+}
+
+type SessionCacheMetrics struct {
+	Hits          uint64  `json:"hits"`
+	Misses        uint64  `json:"misses"`
+	Invalidations uint64  `json:"invalidations"`
+	HitRatio      float64 `json:"hitRatio"`
+	Size          int     `json:"size"`
+}
+
+// SessionCache is a small in-process cache of sessions recently confirmed
+// alive, sitting in front of the Redis Ping done by SessionChecker. Only
+// positive results are cached; every instance drops entries as soon as a
+// revocation is published over Redis pub/sub, and the TTL bounds staleness if
+// a message is ever lost. generation counts the invalidations applied, so a
+// result fetched while one arrived is not remembered as live.
+type SessionCache struct {
+	mu         sync.Mutex
+	entries    map[string]sessionCacheEntry
+	generation uint64
+	ttl        time.Duration
+	maxEntries int
+	redis      redis.UniversalClient
+
+	hits          atomic.Uint64
+	misses        atomic.Uint64
+	invalidations atomic.Uint64
+}
+
+func NewSessionCache(redis redis.UniversalClient, ttl time.Duration, maxEntries int) *SessionCache {
+	return &SessionCache{
+		entries:    make(map[string]sessionCacheEntry),
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		redis:      redis,
+	}
+}
+
+func (s *SessionCache) Alive(sessionId string) bool {
+	s.mu.Lock()
+	entry, found := s.entries[sessionId]
+	if found && time.Now().After(entry.expiresAt) {
+		delete(s.entries, sessionId)
+		found = false
+	}
+	s.mu.Unlock()
+
+	if found {
+		s.hits.Add(1)
+	} else {
+		s.misses.Add(1)
+	}
+	return found
+}
+
+// Generation is taken before looking a session up, and handed to Remember.
+func (s *SessionCache) Generation() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.generation
+}
+
+// Remember caches a session found alive, unless an invalidation was applied
+// since generation was taken: it may have revoked that very session after
+// the lookup saw it alive.
+func (s *SessionCache) Remember(sessionId string, accountUUID string, generation uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if generation != s.generation {
+		return
+	}
+
+	now := time.Now()
+	if len(s.entries) >= s.maxEntries {
+		for id, entry := range s.entries {
+			if now.After(entry.expiresAt) {
+				delete(s.entries, id)
+			}
+		}
+		if len(s.entries) >= s.maxEntries {
+			s.entries = make(map[string]sessionCacheEntry)
+		}
+	}
+
+	s.entries[sessionId] = sessionCacheEntry{accountUUID: accountUUID, expiresAt: now.Add(s.ttl)}
+}
+
+func (s *SessionCache) apply(invalidation sessionInvalidation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.generation++
+	switch {
+	case invalidation.SessionID != "":
+		delete(s.entries, invalidation.SessionID)
+	case invalidation.AccountUUID != "":
+		for id, entry := range s.entries {
+			if entry.accountUUID == invalidation.AccountUUID {
+				delete(s.entries, id)
+			}
+		}
+	}
+}
+
+func (s *SessionCache) publish(ctx context.Context, invalidation sessionInvalidation) error {
+	s.apply(invalidation)
+
+	payload, errMarshal := json.Marshal(invalidation)
+	if errMarshal != nil {
+		return errMarshal
+	}
+	return s.redis.Publish(ctx, SessionInvalidationChannel, payload).Err()
+}
+
+func (s *SessionCache) InvalidateSession(ctx context.Context, sessionId string) error {
+	return s.publish(ctx, sessionInvalidation{SessionID: sessionId})
+}
+
+func (s *SessionCache) InvalidateAccount(ctx context.Context, accountUUID string) error {
+	return s.publish(ctx, sessionInvalidation{AccountUUID: accountUUID})
+}
+
+// Subscribe applies invalidations published by every instance, this one
+// included, until ctx is cancelled.
+func (s *SessionCache) Subscribe(ctx context.Context) {
+	subscription := s.redis.Subscribe(ctx, SessionInvalidationChannel)
+	go func() {
+		defer subscription.Close()
+		messages := subscription.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message, open := <-messages:
+				if !open {
+					return
+				}
+
+				var invalidation sessionInvalidation
+				if errUnmarshal := json.Unmarshal([]byte(message.Payload), &invalidation); errUnmarshal != nil {
+					Logger.Error("session-cache-invalidation", "component", LogComponent, "error", errUnmarshal.Error())
+					continue
+				}
+				s.apply(invalidation)
+				s.invalidations.Add(1)
+			}
+		}
+	}()
+}
+
+func (s *SessionCache) Metrics() SessionCacheMetrics {
+	s.mu.Lock()
+	size := len(s.entries)
+	s.mu.Unlock()
+
+	metrics := SessionCacheMetrics{
+		Hits:          s.hits.Load(),
+		Misses:        s.misses.Load(),
+		Invalidations: s.invalidations.Load(),
+		Size:          size,
+	}
+	if lookups := metrics.Hits + metrics.Misses; lookups > 0 {
+		metrics.HitRatio = float64(metrics.Hits) / float64(lookups)
+	}
+	return metrics
+}
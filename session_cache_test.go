@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionCacheRemember(t *testing.T) {
+	cases := []struct {
+		name       string
+		invalidate *sessionInvalidation
+		wantAlive  bool
+	}{
+		{name: "no invalidation", wantAlive: true},
+		{name: "session revoked during the ping", invalidate: &sessionInvalidation{SessionID: "s1"}, wantAlive: false},
+		{name: "account revoked during the ping", invalidate: &sessionInvalidation{AccountUUID: "a1"}, wantAlive: false},
+		// the generation is coarse: any invalidation skips the remember
+		{name: "other session revoked during the ping", invalidate: &sessionInvalidation{SessionID: "s2"}, wantAlive: false},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cache := NewSessionCache(nil, time.Minute, 10)
+
+			generation := cache.Generation()
+			if testCase.invalidate != nil {
+				cache.apply(*testCase.invalidate)
+			}
+			cache.Remember("s1", "a1", generation)
+
+			if alive := cache.Alive("s1"); alive != testCase.wantAlive {
+				t.Fatalf("alive %v, want %v", alive, testCase.wantAlive)
+			}
+		})
+	}
+}
+
+func TestSessionCacheInvalidation(t *testing.T) {
+	cache := NewSessionCache(nil, time.Minute, 10)
+	cache.Remember("s1", "a1", cache.Generation())
+	cache.Remember("s2", "a1", cache.Generation())
+	cache.Remember("s3", "a2", cache.Generation())
+
+	cache.apply(sessionInvalidation{SessionID: "s1"})
+	if cache.Alive("s1") || !cache.Alive("s2") {
+		t.Fatal("session invalidation dropped the wrong entries")
+	}
+	cache.apply(sessionInvalidation{AccountUUID: "a1"})
+	if cache.Alive("s2") || !cache.Alive("s3") {
+		t.Fatal("account invalidation dropped the wrong entries")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"github.com/21strive/commonuser"
+	"github.com/21strive/commonuser/account"
+	"github.com/21strive/commonuser/session"
+)
+
+var SessionInvalid = errors.New("session revoked or expired")
+
+// SessionChecker confirms that the session behind an access token is still
+// alive, so a revocation takes effect before the token expires.
+type SessionChecker struct {
+	commonuser        *commonuser.Service
+	commonuserFetcher *commonuser.Fetchers
+	cache             *SessionCache
+}
+
+func NewSessionChecker(commonuser *commonuser.Service, commonuserFetchers *commonuser.Fetchers, cache *SessionCache) *SessionChecker {
+	return &SessionChecker{
+		commonuser:        commonuser,
+		commonuserFetcher: commonuserFetchers,
+		cache:             cache,
+	}
+}
+
+// Check consults the in-process cache first, then pings the session in the
+// Redis cache. Only when the library reports that the account's sessions were
+// evicted (session.SeedRequired) are they re-seeded from the database before
+// a second ping; any other miss is a revoked or expired session, so a
+// revoked token that keeps being replayed never reaches the database.
+func (s *SessionChecker) Check(account *account.Account, sessionId string) error {
+	if s.cache.Alive(sessionId) {
+		return nil
+	}
+
+	generation := s.cache.Generation()
+	_, errPing := s.commonuserFetcher.Session().Ping(sessionId)
+	if errPing == nil {
+		s.cache.Remember(sessionId, account.GetUUID(), generation)
+		return nil
+	}
+	if !errors.Is(errPing, session.SeedRequired) {
+		return errors.Join(SessionInvalid, errPing)
+	}
+
+	errSeed := s.commonuser.Session().SeedByAccount(account)
+	if errSeed != nil {
+		return errSeed
+	}
+
+	_, errPing = s.commonuserFetcher.Session().Ping(sessionId)
+	if errPing != nil {
+		return errors.Join(SessionInvalid, errPing)
+	}
+
+	s.cache.Remember(sessionId, account.GetUUID(), generation)
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.]*$`)
+
+// FieldError is one failed rule, named after the JSON field so clients can
+// show it next to the right input.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
+
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, fieldError := range e {
+		messages = append(messages, fieldError.Field+": "+fieldError.Message)
+	}
+	return "validation failed: " + strings.Join(messages, "; ")
+}
+
+type validationRule struct {
+	name  string
+	param string
+	limit int
+}
+
+type fieldRules struct {
+	index []int
+	name  string
+	rules []validationRule
+}
+
+// Validator checks request payloads against their `binding` tags. Rules are
+// comma separated: required, min=N and max=N (in characters), email,
+// username, url and locale (one of SupportedLanguages). Apart from required,
+// rules are skipped for empty fields.
+type Validator struct {
+	mu    sync.RWMutex
+	types map[reflect.Type][]fieldRules
+}
+
+func NewValidator() *Validator {
+	return &Validator{types: map[reflect.Type][]fieldRules{}}
+}
+
+// Register compiles the rules of the given struct values up front, so a typo
+// in a tag fails at startup rather than on the first request.
+func (v *Validator) Register(payloads ...any) {
+	for _, payload := range payloads {
+		if _, errCompile := v.rules(reflect.TypeOf(payload)); errCompile != nil {
+			panic(errCompile)
+		}
+	}
+}
+
+func (v *Validator) rules(t reflect.Type) ([]fieldRules, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	v.mu.RLock()
+	compiled, found := v.types[t]
+	v.mu.RUnlock()
+	if found {
+		return compiled, nil
+	}
+
+	compiled, errCompile := compileRules(t, nil)
+	if errCompile != nil {
+		return nil, errCompile
+	}
+
+	v.mu.Lock()
+	v.types[t] = compiled
+	v.mu.Unlock()
+	return compiled, nil
+}
+
+func compileRules(t reflect.Type, parent []int) ([]fieldRules, error) {
+	var compiled []fieldRules
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		index := append(append([]int{}, parent...), i)
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			nested, errNested := compileRules(field.Type, index)
+			if errNested != nil {
+				return nil, errNested
+			}
+			compiled = append(compiled, nested...)
+			continue
+		}
+
+		tag := field.Tag.Get("binding")
+		if tag == "" {
+			continue
+		}
+		if field.Type.Kind() != reflect.String {
+			return nil, fmt.Errorf("%s.%s: binding rules only apply to strings", t.Name(), field.Name)
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" {
+			name = field.Name
+		}
+
+		entry := fieldRules{index: index, name: name}
+		for _, rawRule := range strings.Split(tag, ",") {
+			ruleName, param, _ := strings.Cut(strings.TrimSpace(rawRule), "=")
+			rule := validationRule{name: ruleName, param: param}
+
+			switch ruleName {
+			case "required", "email", "username", "url", "locale":
+			case "min", "max":
+				limit, errLimit := strconv.Atoi(param)
+				if errLimit != nil || limit < 0 {
+					return nil, fmt.Errorf("%s.%s: %s needs a non-negative integer", t.Name(), field.Name, ruleName)
+				}
+				rule.limit = limit
+			default:
+				return nil, fmt.Errorf("%s.%s: unknown binding rule %q", t.Name(), field.Name, ruleName)
+			}
+			entry.rules = append(entry.rules, rule)
+		}
+		compiled = append(compiled, entry)
+	}
+	return compiled, nil
+}
+
+// Validate returns ValidationErrors listing every failed rule, or nil.
+func (v *Validator) Validate(payload any) error {
+	compiled, errCompile := v.rules(reflect.TypeOf(payload))
+	if errCompile != nil {
+		return errCompile
+	}
+
+	value := reflect.Indirect(reflect.ValueOf(payload))
+	var failures ValidationErrors
+	for _, entry := range compiled {
+		fieldValue := value.FieldByIndex(entry.index).String()
+		for _, rule := range entry.rules {
+			if message, ok := rule.check(fieldValue); !ok {
+				failures = append(failures, FieldError{
+					Field:   entry.name,
+					Rule:    rule.name,
+					Param:   rule.param,
+					Message: message,
+				})
+				break
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		return failures
+	}
+	return nil
+}
+
+func (r validationRule) check(value string) (string, bool) {
+	if r.name == "required" {
+		return "is required", strings.TrimSpace(value) != ""
+	}
+	if value == "" {
+		return "", true
+	}
+
+	switch r.name {
+	case "min":
+		return fmt.Sprintf("must be at least %d characters", r.limit), utf8.RuneCountInString(value) >= r.limit
+	case "max":
+		return fmt.Sprintf("must be at most %d characters", r.limit), utf8.RuneCountInString(value) <= r.limit
+	case "email":
+		address, errParse := mail.ParseAddress(value)
+		return "must be a valid email address", errParse == nil && address.Address == value
+	case "username":
+		return "may only contain letters, digits, dots and underscores, and must start with a letter or digit", usernamePattern.MatchString(value)
+	case "url":
+		parsed, errParse := url.Parse(value)
+		return "must be an http or https URL", errParse == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+	case "locale":
+		return "must be one of " + strings.Join(SupportedLanguages, ", "), isSupportedLanguage(value)
+	}
+	return "", true
+}
+
+var RequestValidator = newRequestValidator()
+
+func newRequestValidator() *Validator {
+	validator := NewValidator()
+	validator.Register(
+		NativeRegister{}, VerifyRegistration{}, LoginWithEmail{}, LoginWithUsername{},
+		AuthWithGoogle{}, LinkWithGoogle{}, ConfirmProviderLink{}, UpdateAccount{},
+		UpdateEmail{}, ValidateUpdateEmail{}, RevokeUpdateEmail{}, UpdatePassword{},
+		SetInitialPassword{}, ForgotPassword{}, ResetPassword{},
+	)
+	return validator
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type validationProfile struct {
+	Website string `json:"website" binding:"url"`
+	Locale  string `json:"locale" binding:"locale"`
+}
+
+type validationPayload struct {
+	Email    string `json:"email" binding:"required,email"`
+	Username string `json:"username" binding:"username,min=3,max=8"`
+	Nickname string `binding:"max=4"`
+	Ignored  string `json:"ignored"`
+	validationProfile
+}
+
+func validPayload() validationPayload {
+	return validationPayload{
+		Email:             "budi@example.com",
+		Username:          "budi_s",
+		validationProfile: validationProfile{Website: "https://example.com", Locale: "id"},
+	}
+}
+
+func TestValidatorRules(t *testing.T) {
+	validator := NewValidator()
+
+	cases := []struct {
+		name   string
+		change func(payload *validationPayload)
+		want   []FieldError
+	}{
+		{name: "valid", change: func(*validationPayload) {}},
+		{name: "optional fields empty", change: func(payload *validationPayload) {
+			payload.Username, payload.Website, payload.Locale = "", "", ""
+		}},
+		{name: "required missing", change: func(payload *validationPayload) { payload.Email = "" },
+			want: []FieldError{{Field: "email", Rule: "required"}}},
+		{name: "required blank", change: func(payload *validationPayload) { payload.Email = "   " },
+			want: []FieldError{{Field: "email", Rule: "required"}}},
+		{name: "email", change: func(payload *validationPayload) { payload.Email = "Budi <budi@example.com>" },
+			want: []FieldError{{Field: "email", Rule: "email"}}},
+		{name: "username", change: func(payload *validationPayload) { payload.Username = "_budi" },
+			want: []FieldError{{Field: "username", Rule: "username"}}},
+		{name: "min counts characters", change: func(payload *validationPayload) { payload.Username = "bu" },
+			want: []FieldError{{Field: "username", Rule: "min", Param: "3"}}},
+		{name: "max", change: func(payload *validationPayload) { payload.Username = "budisantoso" },
+			want: []FieldError{{Field: "username", Rule: "max", Param: "8"}}},
+		{name: "max counts runes", change: func(payload *validationPayload) { payload.Nickname = "ñaña" }},
+		{name: "field name without json tag", change: func(payload *validationPayload) { payload.Nickname = "budii" },
+			want: []FieldError{{Field: "Nickname", Rule: "max", Param: "4"}}},
+		{name: "nested url", change: func(payload *validationPayload) { payload.Website = "ftp://example.com" },
+			want: []FieldError{{Field: "website", Rule: "url"}}},
+		{name: "nested url without host", change: func(payload *validationPayload) { payload.Website = "https://" },
+			want: []FieldError{{Field: "website", Rule: "url"}}},
+		{name: "nested locale", change: func(payload *validationPayload) { payload.Locale = "fr" },
+			want: []FieldError{{Field: "locale", Rule: "locale"}}},
+		{name: "every failing field, first rule only", change: func(payload *validationPayload) {
+			payload.Email, payload.Username, payload.Locale = "", "_b", "fr"
+		}, want: []FieldError{
+			{Field: "email", Rule: "required"},
+			{Field: "username", Rule: "username"},
+			{Field: "locale", Rule: "locale"},
+		}},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			payload := validPayload()
+			testCase.change(&payload)
+
+			errValidate := validator.Validate(&payload)
+			if testCase.want == nil {
+				if errValidate != nil {
+					t.Fatalf("unexpected failure: %v", errValidate)
+				}
+				return
+			}
+
+			var failures ValidationErrors
+			if !errors.As(errValidate, &failures) {
+				t.Fatalf("error %v, want ValidationErrors", errValidate)
+			}
+			for i := range failures {
+				if failures[i].Message == "" {
+					t.Errorf("%s has no message", failures[i].Field)
+				}
+				failures[i].Message = ""
+			}
+			if !reflect.DeepEqual([]FieldError(failures), testCase.want) {
+				t.Fatalf("failures %+v, want %+v", failures, testCase.want)
+			}
+		})
+	}
+}
+
+func TestValidatorRejectsBadTags(t *testing.T) {
+	cases := []struct {
+		name    string
+		payload any
+		want    string
+	}{
+		{name: "unknown rule", payload: struct {
+			Name string `binding:"requried"`
+		}{}, want: "unknown binding rule"},
+		{name: "bad limit", payload: struct {
+			Name string `binding:"min=three"`
+		}{}, want: "non-negative integer"},
+		{name: "negative limit", payload: struct {
+			Name string `binding:"max=-1"`
+		}{}, want: "non-negative integer"},
+		{name: "not a string", payload: struct {
+			Age int `binding:"required"`
+		}{}, want: "only apply to strings"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			errValidate := NewValidator().Validate(testCase.payload)
+			if errValidate == nil || !strings.Contains(errValidate.Error(), testCase.want) {
+				t.Fatalf("error %v, want one mentioning %q", errValidate, testCase.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+const verifiedEmailSchema = `
+CREATE TABLE IF NOT EXISTS verified_email (
+	account_uuid TEXT PRIMARY KEY,
+	email        TEXT NOT NULL,
+	verified_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+`
+
+// VerifiedEmails records which address of each account has been proven to
+// belong to its owner: by the registration code, an email-change token, a
+// reset token or a provider that verified it. Auto-linking a provider by
+// email relies on it, so an attacker who registered someone else's address
+// without verifying it cannot have that person's provider login linked to
+// the attacker's account. Accounts verified before the table existed have
+// no record and are treated as unverified.
+type VerifiedEmails struct{}
+
+func NewVerifiedEmails() *VerifiedEmails {
+	return &VerifiedEmails{}
+}
+
+func (v *VerifiedEmails) EnsureSchema(db *sql.DB) error {
+	_, errExec := db.Exec(verifiedEmailSchema)
+	return errExec
+}
+
+func (v *VerifiedEmails) Mark(db sqlExecutor, accountUUID string, email string) error {
+	if email == "" {
+		return nil
+	}
+	_, errExec := db.Exec(`
+		INSERT INTO verified_email (account_uuid, email) VALUES ($1, $2)
+		ON CONFLICT (account_uuid) DO UPDATE SET email = EXCLUDED.email, verified_at = now()`,
+		accountUUID, strings.ToLower(email))
+	return errExec
+}
+
+// IsVerified reports whether email is the account's verified address.
+func (v *VerifiedEmails) IsVerified(db *sql.DB, accountUUID string, email string) (bool, error) {
+	var verified string
+	errScan := db.QueryRow(`SELECT email FROM verified_email WHERE account_uuid = $1`, accountUUID).Scan(&verified)
+	if errors.Is(errScan, sql.ErrNoRows) {
+		return false, nil
+	}
+	if errScan != nil {
+		return false, errScan
+	}
+	return email != "" && verified == strings.ToLower(email), nil
+}